@@ -0,0 +1,390 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArchivePath returns the path of the directory where old package files are
+// kept when r.KeepVersions is set.
+func (r Repository) ArchivePath() string {
+	return filepath.Join(r.Path, "archive")
+}
+
+// parsePackageFileName splits a package file name like
+// "foo-bar-1:2.3-4-x86_64.pkg.tar.zst" into the package name ("foo-bar") and
+// the version ("1:2.3-4").
+func parsePackageFileName(fileName string) (name, version string, ok bool) {
+	idx := strings.LastIndex(fileName, ".pkg.tar")
+	if idx < 0 {
+		return "", "", false
+	}
+	fields := strings.Split(fileName[:idx], "-")
+	if len(fields) < 4 {
+		return "", "", false
+	}
+	n := len(fields)
+	return strings.Join(fields[:n-3], "-"), fields[n-3] + "-" + fields[n-2], true
+}
+
+// discardPackageFile removes an old package file (and its signature) from the
+// target directory. If r.KeepVersions is set, the files are moved into the
+// archive directory instead.
+func (r Repository) discardPackageFile(fileName string) error {
+	for _, name := range []string{fileName, fileName + ".sig"} {
+		path := filepath.Join(r.Path, name)
+		if r.KeepVersions == 0 {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = os.MkdirAll(r.ArchivePath(), 0755)
+		if err != nil {
+			return err
+		}
+		archivedPath := filepath.Join(r.ArchivePath(), name)
+
+		//symlinks to package files for architecture "any" in the directory of
+		//another architecture point to the archive of that architecture instead
+		if fi.Mode()&os.ModeSymlink != 0 && r.AnyPackagesFrom != nil {
+			relPath, err := filepath.Rel(r.ArchivePath(), r.AnyPackagesFrom.ArchivePath())
+			if err != nil {
+				return err
+			}
+			err = ensureSymlink(filepath.Join(relPath, name), archivedPath)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = os.Rename(path, archivedPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedPackage is a package file in the archive directory.
+type archivedPackage struct {
+	FileName string
+	Name     string
+	Version  string
+}
+
+// listArchivedPackages returns the package files in the archive directory
+// (plus the `additional` ones), grouped by package name and sorted from newest
+// to oldest version.
+func (r Repository) listArchivedPackages(additional []string) (map[string][]archivedPackage, error) {
+	var names []string
+	dir, err := os.Open(r.ArchivePath())
+	switch {
+	case err == nil:
+		names, err = dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	names = append(names, additional...)
+
+	result := make(map[string][]archivedPackage)
+	for _, fileName := range names {
+		if !isPackageFile(fileName) {
+			continue
+		}
+		name, version, ok := parsePackageFileName(fileName)
+		if ok {
+			result[name] = append(result[name], archivedPackage{fileName, name, version})
+		}
+	}
+	for _, pkgs := range result {
+		sort.Slice(pkgs, func(i, j int) bool {
+			cmp := vercmp(pkgs[i].Version, pkgs[j].Version)
+			if cmp == 0 {
+				return pkgs[i].FileName < pkgs[j].FileName
+			}
+			return cmp > 0
+		})
+	}
+	return result, nil
+}
+
+// pruneArchive removes all but the newest r.KeepVersions versions of each
+// package from the archive directory, as well as archived files that are also
+// present in the target directory.
+func (r Repository) pruneArchive(ui *UI) (ok bool) {
+	fileNames, err := r.findOldArchivedFiles(nil)
+	if err != nil {
+		ui.ShowError(err)
+		return false
+	}
+
+	ok = true
+	for _, fileName := range fileNames {
+		for _, name := range []string{fileName, fileName + ".sig"} {
+			err := os.Remove(filepath.Join(r.ArchivePath(), name))
+			if err != nil && !os.IsNotExist(err) {
+				ui.ShowError(err)
+				ok = false
+			}
+		}
+	}
+	return
+}
+
+// findOldArchivedFiles returns the names of the package files that
+// pruneArchive() removes. The `additional` files are treated as if they were
+// in the archive already (this is used by dry runs).
+func (r Repository) findOldArchivedFiles(additional []string) ([]string, error) {
+	archived, err := r.listArchivedPackages(additional)
+	if err != nil {
+		return nil, err
+	}
+
+	isAdditional := make(map[string]bool, len(additional))
+	for _, fileName := range additional {
+		isAdditional[fileName] = true
+	}
+
+	var result []string
+	for _, pkgs := range archived {
+		//the archive may contain multiple files with the same version (e.g. with
+		//different compression formats); these count as one version
+		versionCount := uint(0)
+		lastVersion := ""
+		for _, pkg := range pkgs {
+			//files that were rebuilt after a rollback are not old anymore
+			isCurrent := false
+			if !isAdditional[pkg.FileName] {
+				isCurrent, err = fileExists(filepath.Join(r.Path, pkg.FileName))
+				if err != nil {
+					return nil, err
+				}
+			}
+			if !isCurrent {
+				if versionCount == 0 || vercmp(pkg.Version, lastVersion) != 0 {
+					versionCount++
+					lastVersion = pkg.Version
+				}
+				if versionCount <= r.KeepVersions {
+					continue
+				}
+			}
+			result = append(result, pkg.FileName)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// rollbackPackage moves an archived version of the given package back into the
+// target directory, and replaces the current version of the package in the
+// repository metadata with it. If `version` is empty, the newest archived
+// version that is older than the current version is chosen. Returns the file
+// name of the restored package, or an empty string if no suitable version was
+// found.
+func (r Repository) rollbackPackage(pkgName, version string) (string, error) {
+	entries, err := r.readMetadata()
+	if err != nil {
+		return "", err
+	}
+	currentVersion := ""
+	for _, entry := range entries {
+		if entry.PackageName == pkgName {
+			currentVersion = entry.Version
+		}
+	}
+	archived, err := r.listArchivedPackages(nil)
+	if err != nil {
+		return "", err
+	}
+
+	var pkg *archivedPackage
+	for idx, candidate := range archived[pkgName] {
+		if version == "" && (currentVersion == "" || vercmp(candidate.Version, currentVersion) < 0) {
+			pkg = &archived[pkgName][idx]
+			break
+		}
+		if version != "" && vercmp(candidate.Version, version) == 0 {
+			pkg = &archived[pkgName][idx]
+			break
+		}
+	}
+	if pkg == nil {
+		return "", nil
+	}
+
+	//move the files back into the target directory
+	for _, name := range []string{pkg.FileName, pkg.FileName + ".sig"} {
+		archivedPath := filepath.Join(r.ArchivePath(), name)
+		fi, err := os.Lstat(archivedPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 && r.AnyPackagesFrom != nil {
+			relPath, err := filepath.Rel(r.Path, r.AnyPackagesFrom.Path)
+			if err != nil {
+				return "", err
+			}
+			err = ensureSymlink(filepath.Join(relPath, name), filepath.Join(r.Path, name))
+			if err == nil {
+				err = os.Remove(archivedPath)
+			}
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		err = os.Rename(archivedPath, filepath.Join(r.Path, name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = r.addToMetadata([]string{pkg.FileName})
+	if err != nil {
+		return "", fmt.Errorf("cannot add %s to repository metadata: %s", pkg.FileName, err.Error())
+	}
+	return pkg.FileName, nil
+}
+
+// loadPins fills s.pinnedFiles and s.pinnedPackages from the pins that `art
+// rollback` recorded in the cache. When the package definition of a pinned
+// package has changed since the rollback, the pin is removed, so that the
+// package is built and published again.
+func (s *Session) loadPins() (ok bool) {
+	if len(s.Cache.Pinned) == 0 {
+		return true
+	}
+	s.pinnedFiles = make(map[*Repository]map[string]string)
+	s.pinnedPackages = make(map[string]bool)
+	isValid := make(map[string]bool)
+
+	ok = true
+	for _, src := range s.Config.Sources {
+		for _, pkg := range src.Packages {
+			entry, err := s.Cache.GetEntryForPackage(pkg)
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+				continue
+			}
+			for _, name := range entry.Relations.Names {
+				pin, exists := s.Cache.GetPin(src.Target, name)
+				if !exists || pin.CacheKey != pkg.CacheKey() {
+					continue
+				}
+				if pin.ContentHash != entry.ContentHash {
+					s.UI.ShowInfo("ending rollback of %s in %s: its package definition has changed", name, src.Target.DisplayName())
+					continue
+				}
+				isValid[pinCacheKey(src.Target, name)] = true
+				if s.pinnedFiles[src.Target] == nil {
+					s.pinnedFiles[src.Target] = make(map[string]string)
+				}
+				s.pinnedFiles[src.Target][name] = pin.FileName
+				s.pinnedPackages[pkg.CacheKey()] = true
+			}
+		}
+	}
+
+	//pins of packages that are gone are removed as well (unless discovery
+	//failed, in which case some packages might be missing)
+	if ok {
+		s.Cache.RemovePins(isValid)
+	}
+	return ok
+}
+
+// isPinned returns whether the given package is not built because it was
+// rolled back.
+func (s *Session) isPinned(pkg Package) bool {
+	return s.pinnedPackages[pkg.CacheKey()]
+}
+
+// pinnedFileName returns the package file that was restored by `art rollback`
+// for the package of the given output file, or the output file itself if that
+// package was not rolled back.
+func (s *Session) pinnedFileName(target *Repository, fileName string) string {
+	name, _, ok := parsePackageFileName(fileName)
+	if ok {
+		if pinned, exists := s.pinnedFiles[target][name]; exists {
+			return pinned
+		}
+	}
+	return fileName
+}
+
+// applyPins replaces the output files of rolled-back packages in the given
+// lists with the restored package files.
+func (s *Session) applyPins(allOutputFiles map[*Repository][]string) {
+	for target, fileNames := range allOutputFiles {
+		for idx, fileName := range fileNames {
+			fileNames[idx] = s.pinnedFileName(target, fileName)
+		}
+	}
+}
+
+// findPackageByName returns the package that builds the package with the given
+// name for the given target, or nil if there is none.
+func (s *Session) findPackageByName(target *Repository, pkgName string) (Package, PackageCacheEntry, error) {
+	for _, src := range s.Config.Sources {
+		if src.Target != target {
+			continue
+		}
+		for _, pkg := range src.Packages {
+			entry, err := s.Cache.GetEntryForPackage(pkg)
+			if err != nil {
+				return nil, PackageCacheEntry{}, err
+			}
+			for _, name := range entry.Relations.Names {
+				if name == pkgName {
+					return pkg, entry, nil
+				}
+			}
+		}
+	}
+	return nil, PackageCacheEntry{}, nil
+}
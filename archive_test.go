@@ -0,0 +1,96 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPins(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	path := filepath.Join(dirPath, "PKGBUILD")
+	err = ioutil.WriteFile(path, []byte("pkgver=1"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &Repository{Name: "test", Path: "/repo"}
+	foo := &testPackage{Name: "foo", Inputs: []string{path}}
+	bar := &testPackage{Name: "bar"}
+	c := newTestCache()
+	fooEntry, err := c.GetEntryForPackage(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetPin(target, "foo", PinnedCacheEntry{CacheKey: "foo", ContentHash: fooEntry.ContentHash, FileName: "foo-0.9-1-any.pkg.tar.zst"})
+	c.SetPin(target, "bar", PinnedCacheEntry{CacheKey: "bar", ContentHash: "outdated", FileName: "bar-0.9-1-any.pkg.tar.zst"})
+	c.SetPin(target, "gone", PinnedCacheEntry{CacheKey: "gone", FileName: "gone-0.9-1-any.pkg.tar.zst"})
+
+	newTestSession := func() *Session {
+		return &Session{
+			UI: &UI{},
+			Config: &Configuration{
+				Sources: []*Source{{Target: target, Packages: []Package{foo, bar}}},
+				Targets: []*Repository{target},
+			},
+			Cache: c,
+		}
+	}
+
+	//only the pin of the unchanged package remains
+	s := newTestSession()
+	if !s.loadPins() {
+		t.Fatal("loadPins failed")
+	}
+	if !s.isPinned(foo) || s.isPinned(bar) {
+		t.Errorf("expected only foo to be pinned, got pinnedPackages = %v", s.pinnedPackages)
+	}
+	allOutputFiles := map[*Repository][]string{
+		target: {"foo-1.0-1-any.pkg.tar.zst", "bar-1.0-1-any.pkg.tar.zst"},
+	}
+	s.applyPins(allOutputFiles)
+	expected := []string{"foo-0.9-1-any.pkg.tar.zst", "bar-1.0-1-any.pkg.tar.zst"}
+	if !reflect.DeepEqual(allOutputFiles[target], expected) {
+		t.Errorf("expected output files %v, got %v", expected, allOutputFiles[target])
+	}
+	if _, exists := c.GetPin(target, "foo"); !exists || len(c.Pinned) != 1 {
+		t.Errorf("expected only the pin for foo to remain, got %v", c.Pinned)
+	}
+
+	//changing the package definition ends the rollback
+	err = ioutil.WriteFile(path, []byte("pkgver=1\npkgrel=2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestSession()
+	if !s.loadPins() {
+		t.Fatal("loadPins failed")
+	}
+	if s.isPinned(foo) || len(c.Pinned) != 0 {
+		t.Errorf("expected no pins to remain, got %v", c.Pinned)
+	}
+}
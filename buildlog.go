@@ -0,0 +1,168 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogConfig is the [logs] section of the configuration file.
+type LogConfig struct {
+	//Path is the directory where build logs are written.
+	Path string `toml:"path"`
+	//Keep is the number of build logs that are kept for each package.
+	Keep uint `toml:"keep"`
+}
+
+const (
+	defaultLogPath  = ".art-logs"
+	defaultKeepLogs = 5
+)
+
+// BuildLog is an io.Writer that writes the output of a package build into a
+// log file below LogConfig.Path, with a timestamp in front of each line. The
+// log file is only created when something is written to it, so that no log
+// files are left behind for packages that do not need to be built.
+type BuildLog struct {
+	Path        string
+	keep        uint
+	startTime   time.Time
+	file        *os.File
+	atLineStart bool
+}
+
+// newBuildLog prepares the log for building the given package. The log file
+// is at "$path/$target/$pkgname/$timestamp.log", or at
+// "$path/$target/$arch/$pkgname/$timestamp.log" for targets with multiple
+// architectures.
+func (cfg LogConfig) newBuildLog(node *BuildNode) *BuildLog {
+	dirPath := filepath.Join(cfg.Path, node.Target.Name)
+	if node.Target.Architecture != "" {
+		dirPath = filepath.Join(dirPath, node.Target.Architecture)
+	}
+	if len(node.Entry.Relations.Names) > 0 {
+		dirPath = filepath.Join(dirPath, node.Entry.Relations.Names[0])
+	} else {
+		dirPath = filepath.Join(dirPath, filepath.Base(filepath.Dir(node.Package.DefinitionPath())))
+	}
+
+	now := time.Now()
+	return &BuildLog{
+		Path:        filepath.Join(dirPath, now.Format("20060102-150405")+".log"),
+		keep:        cfg.Keep,
+		startTime:   now,
+		atLineStart: true,
+	}
+}
+
+// Write implements the io.Writer interface.
+func (l *BuildLog) Write(buf []byte) (int, error) {
+	err := l.open()
+	if err != nil {
+		return 0, err
+	}
+
+	var out []byte
+	for _, b := range buf {
+		if l.atLineStart {
+			out = append(out, time.Now().Format("[15:04:05] ")...)
+		}
+		out = append(out, b)
+		l.atLineStart = b == '\n'
+	}
+	_, err = l.file.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// open creates the log file if it does not exist yet, and removes old log
+// files of the same package.
+func (l *BuildLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+	dirPath := filepath.Dir(l.Path)
+	err := os.MkdirAll(dirPath, 0755)
+	if err != nil {
+		return err
+	}
+	l.file, err = os.Create(l.Path)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(l.file, "==> Build started at %s\n", l.startTime.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+
+	//log rotation: the file names sort in chronological order
+	names, err := readDirNames(dirPath)
+	if err != nil {
+		return err
+	}
+	var logNames []string
+	for _, name := range names {
+		if strings.HasSuffix(name, ".log") {
+			logNames = append(logNames, name)
+		}
+	}
+	sort.Strings(logNames)
+	for len(logNames) > int(l.keep) {
+		err := os.Remove(filepath.Join(dirPath, logNames[0]))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logNames = logNames[1:]
+	}
+	return nil
+}
+
+// Close writes the result of the build into the log file and closes it. If
+// nothing was built and there was no error, no log file is created.
+func (l *BuildLog) Close(built bool, buildErr error) error {
+	if l.file == nil && !built && buildErr == nil {
+		return nil
+	}
+	err := l.open()
+	if err != nil {
+		return err
+	}
+
+	if !l.atLineStart {
+		fmt.Fprintln(l.file)
+	}
+	duration := time.Since(l.startTime).Round(time.Second)
+	if buildErr == nil {
+		_, err = fmt.Fprintf(l.file, "==> Build finished successfully after %s\n", duration)
+	} else {
+		_, err = fmt.Fprintf(l.file, "==> Build failed after %s: %s\n", duration, buildErr.Error())
+	}
+	closeErr := l.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -20,32 +20,77 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"time"
+	"strings"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 )
 
 // PackageCacheEntry contains metadata for a Package instance that is held in the Cache.
 type PackageCacheEntry struct {
-	LastModified time.Time
-	OutputFiles  []string
+	//InputFiles and ContentHash describe the package definition and all local
+	//files referenced by it. When the hash changes, the entry is recomputed.
+	InputFiles  []string
+	ContentHash string
+	//OutputSettings is the Package.OutputSettings() at the time when the entry
+	//was computed. When it changes (e.g. when PKGEXT is changed in
+	//makepkg.conf), the entry is recomputed since the OutputFiles change.
+	OutputSettings string
+	//BuiltContentHash is the ContentHash at the time of the last build. If it
+	//differs from ContentHash, the package needs to be rebuilt.
+	BuiltContentHash string
+	OutputFiles      []string
+	Relations        PackageRelations
 }
 
 // OutputCacheEntry contains metadata for an output file that is held in the Cache.
 type OutputCacheEntry struct {
 	MD5Digest string
+	//SignatureDigest is the MD5 digest of the signature file when it was last
+	//verified successfully against the key SignatureKeyID (the Identity() of
+	//the Signer).
+	SignatureDigest string
+	SignatureKeyID  string
+	//The following fields are filled by `art check-rebuilds` (see
+	//scanPackageLibraries) once LibrariesScanned is set.
+	LibrariesScanned  bool
+	NeededLibraries   []string
+	ProvidedLibraries []string
+	LibraryRunPaths   []string
 }
 
-// Cache contains metadata for a number of Package instances.
+// PinnedCacheEntry records a package that was rolled back with `art rollback`.
+// As long as the package definition does not change, the package is not
+// rebuilt, and the restored package file is published instead of the current
+// output file (see Session.loadPins).
+type PinnedCacheEntry struct {
+	//CacheKey and ContentHash identify the Package that builds the rolled-back
+	//package, and its package definition at the time of the rollback.
+	CacheKey    string
+	ContentHash string
+	FileName    string
+}
+
+// Cache contains metadata for a number of Package instances. It is safe for
+// concurrent use.
 type Cache struct {
 	Packages    map[string]PackageCacheEntry `toml:"package"`
 	OutputFiles map[string]OutputCacheEntry  `toml:"output"`
-	Changed     bool                         `toml:"-"`
+	//Pinned is keyed by pinCacheKey().
+	Pinned  map[string]PinnedCacheEntry `toml:"pinned,omitempty"`
+	Changed bool                        `toml:"-"`
+	//inputStamps contains, for each package whose ContentHash was computed or
+	//verified in this run, the sizes and mtimes of its InputFiles at that time
+	//(see stampInputFiles). As long as they do not change, the InputFiles do
+	//not need to be hashed again.
+	inputStamps map[string]string
+	mutex       sync.Mutex
 }
 
 const (
@@ -56,6 +101,7 @@ func readCache() (*Cache, error) {
 	c := &Cache{
 		Packages:    make(map[string]PackageCacheEntry),
 		OutputFiles: make(map[string]OutputCacheEntry),
+		Pinned:      make(map[string]PinnedCacheEntry),
 	}
 
 	bytes, err := ioutil.ReadFile(cachePath)
@@ -69,10 +115,22 @@ func readCache() (*Cache, error) {
 
 	err = toml.Unmarshal(bytes, c)
 	c.Changed = false
+
+	//older versions of ART identified output files by their basename only
+	//(current keys always contain a slash, see outputCacheKey)
+	for key := range c.OutputFiles {
+		if !strings.Contains(key, "/") {
+			delete(c.OutputFiles, key)
+			c.Changed = true
+		}
+	}
 	return c, err
 }
 
 func (c *Cache) writeCache() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if !c.Changed {
 		return nil
 	}
@@ -88,33 +146,144 @@ func (c *Cache) writeCache() error {
 
 // GetEntryForPackage retrieves (or creates) a cache entry for the given Package.
 func (c *Cache) GetEntryForPackage(pkg Package) (PackageCacheEntry, error) {
+	c.mutex.Lock()
 	entry, exists := c.Packages[pkg.CacheKey()]
+	knownStamp := c.inputStamps[pkg.CacheKey()]
+	c.mutex.Unlock()
+
+	//NOTE: Entries written by older versions of ART do not have a ContentHash or Relations.
+	if exists && entry.ContentHash != "" && len(entry.Relations.Names) > 0 && entry.OutputSettings == pkg.OutputSettings() {
+		//the stamp is taken before hashing, so that changes to the files
+		//during hashing are detected by the next call
+		stamp, err := stampInputFiles(entry.InputFiles)
+		if err != nil {
+			return PackageCacheEntry{}, err
+		}
+		if stamp == knownStamp {
+			return entry, nil
+		}
+		hash, err := hashInputFiles(entry.InputFiles)
+		if err != nil {
+			return PackageCacheEntry{}, err
+		}
+		if hash == entry.ContentHash {
+			c.setInputStamp(pkg, stamp)
+			return entry, nil
+		}
+	}
 
-	mtime, err := pkg.LastModified()
+	var err error
+	entry = PackageCacheEntry{
+		OutputSettings:   pkg.OutputSettings(),
+		BuiltContentHash: entry.BuiltContentHash,
+	}
+	entry.InputFiles, err = pkg.InputFiles()
 	if err != nil {
 		return PackageCacheEntry{}, err
 	}
-	if exists && fuzzyTimeEqual(entry.LastModified, mtime) {
-		return entry, nil
+	stamp, err := stampInputFiles(entry.InputFiles)
+	if err != nil {
+		return PackageCacheEntry{}, err
 	}
-
-	entry = PackageCacheEntry{
-		LastModified: mtime,
+	entry.ContentHash, err = hashInputFiles(entry.InputFiles)
+	if err != nil {
+		return PackageCacheEntry{}, err
 	}
 	entry.OutputFiles, err = pkg.OutputFiles()
 	if err != nil {
 		return PackageCacheEntry{}, err
 	}
+	entry.Relations, err = pkg.Relations()
+	if err != nil {
+		return PackageCacheEntry{}, err
+	}
 
+	c.mutex.Lock()
 	c.Packages[pkg.CacheKey()] = entry
 	c.Changed = true
+	c.mutex.Unlock()
+	c.setInputStamp(pkg, stamp)
 	return entry, nil
 }
 
+func (c *Cache) setInputStamp(pkg Package, stamp string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inputStamps == nil {
+		c.inputStamps = make(map[string]string)
+	}
+	c.inputStamps[pkg.CacheKey()] = stamp
+}
+
+func (c *Cache) setBuiltContentHash(pkg Package, hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.Packages[pkg.CacheKey()]
+	if entry.BuiltContentHash != hash {
+		entry.BuiltContentHash = hash
+		c.Packages[pkg.CacheKey()] = entry
+		c.Changed = true
+	}
+}
+
+// hashInputFiles computes a digest over the paths and contents of the given
+// files. Missing files are not an error since they might be added later (which
+// will then change the hash).
+func hashInputFiles(paths []string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		switch {
+		case err == nil:
+			fmt.Fprintf(h, "%s\x00%d\x00", path, len(buf))
+			h.Write(buf)
+		case os.IsNotExist(err):
+			fmt.Fprintf(h, "%s\x00missing\x00", path)
+		default:
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stampInputFiles describes the paths, sizes and mtimes of the given files.
+// It is much cheaper than hashInputFiles(), but only suitable for detecting
+// changes within one run since mtimes are not reliable across checkouts etc.
+func stampInputFiles(paths []string) (string, error) {
+	var buf bytes.Buffer
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		switch {
+		case err == nil:
+			fmt.Fprintf(&buf, "%s\x00%d\x00%d\x00", path, fi.Size(), fi.ModTime().UnixNano())
+		case os.IsNotExist(err):
+			fmt.Fprintf(&buf, "%s\x00missing\x00", path)
+		default:
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// outputCacheKey returns the key for the given output file in
+// Cache.OutputFiles. Output files are identified by their path since different
+// targets may contain different files with the same name. Files in the
+// current directory (for targets with `path = "."`) get a "./" prefix to
+// distinguish them from the basename-only keys of older versions of ART.
+func outputCacheKey(path string) string {
+	path = filepath.Clean(path)
+	if !strings.Contains(path, "/") {
+		return "./" + path
+	}
+	return path
+}
+
 // GetEntryForOutputFile retrieves (or creates) a cache entry for the given output file.
 func (c *Cache) GetEntryForOutputFile(path string) (OutputCacheEntry, error) {
-	baseName := filepath.Base(path)
-	entry, exists := c.OutputFiles[baseName]
+	key := outputCacheKey(path)
+	c.mutex.Lock()
+	entry, exists := c.OutputFiles[key]
+	c.mutex.Unlock()
 	if exists {
 		return entry, nil
 	}
@@ -127,67 +296,183 @@ func (c *Cache) GetEntryForOutputFile(path string) (OutputCacheEntry, error) {
 	entry = OutputCacheEntry{
 		MD5Digest: md5digest(buf),
 	}
-	c.OutputFiles[baseName] = entry
+	c.mutex.Lock()
+	c.OutputFiles[key] = entry
 	c.Changed = true
+	c.mutex.Unlock()
 	return entry, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-// Build performs (if needed) the build of the given package into the given
-// target directory.
-func (c *Cache) Build(pkg Package, targetDirPath string, ui *UI) error {
-	entry, err := c.GetEntryForPackage(pkg)
+// NeedsBuild checks whether the given package needs to be built into the
+// given target directory. This is the case if any output file is missing, if
+// `force` is true, or if the package definition or any of the local files
+// referenced by it have changed since the last build.
+func (c *Cache) NeedsBuild(pkg Package, targetDirPath string, ui *UI, force bool) (entry PackageCacheEntry, needsBuild bool, err error) {
+	entry, err = c.GetEntryForPackage(pkg)
 	if err != nil {
-		return err
+		return entry, false, err
+	}
+	if len(entry.OutputFiles) == 0 {
+		//e.g. packages for architecture "any" when building for multiple
+		//architectures (see ArchVariant.SkipAnyPackages)
+		return entry, false, nil
+	}
+	if entry.BuiltContentHash != "" && entry.BuiltContentHash != entry.ContentHash {
+		force = true
 	}
 
-	var (
-		alreadyBuilt = false
-		needsBuild   = false
-	)
-
+	alreadyBuilt := false
 	for _, fileName := range entry.OutputFiles {
-		fi, err := os.Stat(filepath.Join(targetDirPath, fileName))
-		switch {
-		case err == nil:
+		exists, err := fileExists(filepath.Join(targetDirPath, fileName))
+		if err != nil {
+			return entry, false, err
+		}
+		if exists {
 			alreadyBuilt = true
-			if fi.ModTime().Before(entry.LastModified) {
-				ui.ShowWarning(
-					"not building %s: target file exists and is older than package definition",
-					fileName,
-				)
-			}
-		case os.IsNotExist(err):
+		} else {
 			needsBuild = true
-		default:
-			return err
 		}
 	}
 
 	if alreadyBuilt && needsBuild {
-		return fmt.Errorf(
-			"cannot build package: some of %v exist at target, but some do not",
+		ui.ShowWarning(
+			"rebuilding all of %v: some exist at target, but some do not",
 			entry.OutputFiles,
 		)
 	}
 
-	if !needsBuild {
-		return nil
+	if !needsBuild && !force {
+		//the output files might have been built by an older version of ART
+		//that did not record the BuiltContentHash yet
+		c.setBuiltContentHash(pkg, entry.ContentHash)
+		return entry, false, nil
+	}
+	return entry, true, nil
+}
+
+// Build performs (if needed, see NeedsBuild) the build of the given package
+// into the given target directory. The opts.DestDirPath is ignored and will be
+// filled by this function. The return value `built` indicates whether a build
+// was performed.
+//
+// The build takes place in a scratch directory below the target directory.
+// Only when all output files have been built successfully, they are moved into
+// the target directory together (see moveOutputFiles), so that the target
+// directory never contains a partial set of output files.
+func (c *Cache) Build(pkg Package, targetDirPath string, ui *UI, opts BuildOptions, force bool) (built bool, err error) {
+	entry, needsBuild, err := c.NeedsBuild(pkg, targetDirPath, ui, force)
+	if err != nil || !needsBuild {
+		return false, err
+	}
+
+	scratchDirPath, err := ioutil.TempDir(targetDirPath, ".art-build-")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(scratchDirPath)
+
+	opts.DestDirPath = scratchDirPath
+	err = pkg.Build(opts)
+	if err != nil {
+		return false, err
+	}
+	for _, fileName := range entry.OutputFiles {
+		exists, err := fileExists(filepath.Join(scratchDirPath, fileName))
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, fmt.Errorf("build did not produce the expected output file %s", fileName)
+		}
+	}
+
+	err = moveOutputFiles(scratchDirPath, targetDirPath, entry.OutputFiles)
+	if err != nil {
+		return false, err
+	}
+	c.setBuiltContentHash(pkg, entry.ContentHash)
+
+	//when output files are overwritten, their cached digests become invalid
+	c.mutex.Lock()
+	for _, fileName := range entry.OutputFiles {
+		key := outputCacheKey(filepath.Join(targetDirPath, fileName))
+		if _, exists := c.OutputFiles[key]; exists {
+			delete(c.OutputFiles, key)
+			c.Changed = true
+		}
+	}
+	c.mutex.Unlock()
+	return true, nil
+}
+
+// moveOutputFiles moves the given output files (and their signatures, if
+// any) from the scratch directory into the target directory. Previous versions
+// of these files in the target directory are moved out of the way first (their
+// signatures are not valid for the new files). If moving fails part-way
+// through, the files that were already moved are removed again and the
+// previous versions are restored.
+func moveOutputFiles(scratchDirPath, targetDirPath string, fileNames []string) (err error) {
+	backupDirPath := filepath.Join(scratchDirPath, ".previous")
+	err = os.Mkdir(backupDirPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	var backedUp, moved []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range moved {
+			os.Remove(filepath.Join(targetDirPath, name))
+		}
+		for _, name := range backedUp {
+			os.Rename(filepath.Join(backupDirPath, name), filepath.Join(targetDirPath, name))
+		}
+	}()
+
+	for _, fileName := range fileNames {
+		for _, name := range []string{fileName, fileName + ".sig"} {
+			err = os.Rename(filepath.Join(targetDirPath, name), filepath.Join(backupDirPath, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			backedUp = append(backedUp, name)
+		}
 	}
 
-	return pkg.Build(targetDirPath)
+	for _, fileName := range fileNames {
+		//makepkg creates signatures by itself if BUILDENV contains "sign"
+		for _, name := range []string{fileName, fileName + ".sig"} {
+			err = os.Rename(filepath.Join(scratchDirPath, name), filepath.Join(targetDirPath, name))
+			if os.IsNotExist(err) && name != fileName {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			moved = append(moved, name)
+		}
+	}
+	return nil
 }
 
 // AddMissingSignatures adds signature files to all output files that do not
-// have one yet. It returns a list of the names of all output files.
-func (c *Cache) AddMissingSignatures(pkg Package, targetDirPath string, mcfg MakepkgConfig) ([]string, error) {
+// have one yet, and verifies the existing signatures. Invalid signatures are
+// replaced if `resign` is true, or reported as an error otherwise. It returns
+// a list of the names of all output files.
+func (c *Cache) AddMissingSignatures(pkg Package, targetDirPath string, signer Signer, resign bool, ui *UI) ([]string, error) {
 	entry, err := c.GetEntryForPackage(pkg)
 	if err != nil {
 		return nil, err
 	}
 
-	if mcfg.GPGKeyID != "" {
+	if signer != nil {
 		for _, fileName := range entry.OutputFiles {
 			path := filepath.Join(targetDirPath, fileName)
 			outputExists, err := fileExists(path)
@@ -203,17 +488,16 @@ func (c *Cache) AddMissingSignatures(pkg Package, targetDirPath string, mcfg Mak
 				return nil, err
 			}
 			if signatureExists {
-				continue
+				err := c.VerifySignature(path, signer, false)
+				if err == nil {
+					continue
+				}
+				if !resign {
+					return nil, fmt.Errorf("%s (run `art sign -resign` to replace it)", err.Error())
+				}
+				ui.ShowWarning("%s; signing again", err.Error())
 			}
-			cmd := exec.Command(
-				"gpg", "--detach-sign", "--use-agent",
-				"-u", mcfg.GPGKeyID,
-				"--no-armor", path,
-			)
-			cmd.Stdin = nil
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
+			err = resignFile(signer, path)
 			if err != nil {
 				return nil, err
 			}
@@ -222,3 +506,94 @@ func (c *Cache) AddMissingSignatures(pkg Package, targetDirPath string, mcfg Mak
 
 	return entry.OutputFiles, nil
 }
+
+// VerifySignature verifies the signature of the given output file. Successful
+// verifications are cached until the signature or the key change, unless
+// `force` is true.
+func (c *Cache) VerifySignature(path string, signer Signer, force bool) error {
+	entry, err := c.GetEntryForOutputFile(path)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	digest := md5digest(buf)
+	if !force && entry.SignatureDigest == digest && entry.SignatureKeyID == signer.Identity() {
+		return nil
+	}
+
+	err = signer.Verify(path)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	entry.SignatureDigest = digest
+	entry.SignatureKeyID = signer.Identity()
+	c.OutputFiles[outputCacheKey(path)] = entry
+	c.Changed = true
+	c.mutex.Unlock()
+	return nil
+}
+
+// GetLibrariesForOutputFile retrieves the cache entry for the given output
+// file, and fills its library fields if they have not been filled yet.
+func (c *Cache) GetLibrariesForOutputFile(path string) (OutputCacheEntry, error) {
+	entry, err := c.GetEntryForOutputFile(path)
+	if err != nil || entry.LibrariesScanned {
+		return entry, err
+	}
+
+	entry.NeededLibraries, entry.ProvidedLibraries, entry.LibraryRunPaths, err = scanPackageLibraries(path)
+	if err != nil {
+		return entry, err
+	}
+	entry.LibrariesScanned = true
+
+	c.mutex.Lock()
+	c.OutputFiles[outputCacheKey(path)] = entry
+	c.Changed = true
+	c.mutex.Unlock()
+	return entry, nil
+}
+
+// pinCacheKey returns the key in Cache.Pinned for the package with the given
+// name in the given target.
+func pinCacheKey(target *Repository, pkgName string) string {
+	return outputCacheKey(filepath.Join(target.Path, pkgName))
+}
+
+// GetPin returns the pin for the package with the given name in the given
+// target, if any.
+func (c *Cache) GetPin(target *Repository, pkgName string) (PinnedCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pin, exists := c.Pinned[pinCacheKey(target, pkgName)]
+	return pin, exists
+}
+
+// SetPin records that the package with the given name in the given target was
+// rolled back.
+func (c *Cache) SetPin(target *Repository, pkgName string, pin PinnedCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Pinned == nil {
+		c.Pinned = make(map[string]PinnedCacheEntry)
+	}
+	c.Pinned[pinCacheKey(target, pkgName)] = pin
+	c.Changed = true
+}
+
+// RemovePins removes all pins except for those with the given keys.
+func (c *Cache) RemovePins(keep map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.Pinned {
+		if !keep[key] {
+			delete(c.Pinned, key)
+			c.Changed = true
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetEntryForPackageDetectsChanges(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	path := filepath.Join(dirPath, "PKGBUILD")
+	mtime := time.Unix(1700000000, 0)
+	writeFile := func(contents string, mtime time.Time) {
+		t.Helper()
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		if err == nil {
+			err = os.Chtimes(path, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	getHash := func(c *Cache) string {
+		t.Helper()
+		entry, err := c.GetEntryForPackage(&testPackage{Name: "foo", Inputs: []string{path}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry.ContentHash
+	}
+
+	writeFile("pkgver=1", mtime)
+	c := newTestCache()
+	hash1 := getHash(c)
+
+	//while size and mtime are unchanged, the files are not hashed again
+	writeFile("pkgver=2", mtime)
+	if hash := getHash(c); hash != hash1 {
+		t.Error("expected files with unchanged size and mtime not to be hashed again")
+	}
+	//...but a new run (with a fresh stamp) notices the change
+	c.inputStamps = nil
+	hash2 := getHash(c)
+	if hash2 == hash1 {
+		t.Error("expected changed contents to change the ContentHash")
+	}
+
+	//any change of the mtime leads to rehashing
+	writeFile("pkgver=3", mtime.Add(time.Second))
+	hash3 := getHash(c)
+	if hash3 == hash2 {
+		t.Error("expected changed contents to change the ContentHash")
+	}
+	//touching the file without changing it does not change the hash
+	writeFile("pkgver=3", mtime.Add(2*time.Second))
+	if hash := getHash(c); hash != hash3 {
+		t.Error("expected unchanged contents to keep the ContentHash")
+	}
+	//removing the file changes the hash, restoring it brings it back
+	os.Remove(path)
+	if hash := getHash(c); hash == hash3 {
+		t.Error("expected a missing input file to change the ContentHash")
+	}
+	writeFile("pkgver=3", mtime)
+	if hash := getHash(c); hash != hash3 {
+		t.Error("expected restored contents to restore the ContentHash")
+	}
+}
+
+func TestOutputCacheKeys(t *testing.T) {
+	testCases := []struct {
+		Path     string
+		Expected string
+	}{
+		{"foo-1-1-any.pkg.tar.zst", "./foo-1-1-any.pkg.tar.zst"},
+		{"./foo-1-1-any.pkg.tar.zst", "./foo-1-1-any.pkg.tar.zst"},
+		{filepath.Join(".", "foo-1-1-any.pkg.tar.zst"), "./foo-1-1-any.pkg.tar.zst"},
+		{"repo/./foo-1-1-any.pkg.tar.zst", "repo/foo-1-1-any.pkg.tar.zst"},
+		{"/srv/repo/os/x86_64/foo-1-1-any.pkg.tar.zst", "/srv/repo/os/x86_64/foo-1-1-any.pkg.tar.zst"},
+	}
+	for _, c := range testCases {
+		actual := outputCacheKey(c.Path)
+		if actual != c.Expected {
+			t.Errorf("expected outputCacheKey(%q) = %q, got %q", c.Path, c.Expected, actual)
+		}
+	}
+
+	//entries for a target with `path = "."` survive a roundtrip through the
+	//cache file, but basename-only keys from older versions of ART do not
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	oldWorkDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldWorkDir)
+
+	err = ioutil.WriteFile("foo-1-1-any.pkg.tar.zst", []byte("package"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCache()
+	_, err = c.GetEntryForOutputFile(filepath.Join(".", "foo-1-1-any.pkg.tar.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OutputFiles["bar-1-1-any.pkg.tar.xz"] = OutputCacheEntry{MD5Digest: "legacy"}
+	err = c.writeCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = readCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := c.OutputFiles["./foo-1-1-any.pkg.tar.zst"]; !exists || len(c.OutputFiles) != 1 {
+		t.Errorf("expected only the entry for ./foo-1-1-any.pkg.tar.zst to survive, got %#v", c.OutputFiles)
+	}
+}
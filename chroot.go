@@ -0,0 +1,218 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	//BuilderHost builds native packages with makepkg directly on the host.
+	BuilderHost = "host"
+	//BuilderChroot builds native packages in a clean chroot with makechrootpkg.
+	BuilderChroot = "chroot"
+)
+
+// ChrootConfig is the [chroot] section of the configuration file. In all
+// fields, the placeholder "$arch" is replaced by the target architecture.
+type ChrootConfig struct {
+	//Path is the directory containing the chroot, as used by makechrootpkg(1).
+	//The clean chroot is at "$Path/root", and working copies are created
+	//next to it.
+	Path string `toml:"path"`
+	//PacmanConfigPath and MakepkgConfigPath are optional. When given, they are
+	//used for creating and updating the clean chroot. MakepkgConfigPath is
+	//required for building for architectures other than the host's.
+	PacmanConfigPath  string `toml:"pacman_conf"`
+	MakepkgConfigPath string `toml:"makepkg_conf"`
+}
+
+// ForArchitecture returns a copy of this config with the "$arch" placeholder
+// replaced by the given architecture.
+func (cfg ChrootConfig) ForArchitecture(arch string) ChrootConfig {
+	r := strings.NewReplacer("$arch", arch)
+	return ChrootConfig{
+		Path:              r.Replace(cfg.Path),
+		PacmanConfigPath:  r.Replace(cfg.PacmanConfigPath),
+		MakepkgConfigPath: r.Replace(cfg.MakepkgConfigPath),
+	}
+}
+
+// ChrootBuilder builds native packages inside a clean chroot using the tools
+// from devtools (mkarchroot, arch-nspawn, makechrootpkg). It is safe for
+// concurrent use.
+type ChrootBuilder struct {
+	ChrootConfig
+	//names of working copies that are not currently in use (one per parallel build)
+	copyNames   chan string
+	prepareOnce sync.Once
+	prepareErr  error
+}
+
+// NewChrootBuilder creates a ChrootBuilder that supports up to `jobs`
+// parallel builds.
+func NewChrootBuilder(cfg ChrootConfig, jobs uint) *ChrootBuilder {
+	b := &ChrootBuilder{
+		ChrootConfig: cfg,
+		copyNames:    make(chan string, jobs),
+	}
+	for idx := uint(1); idx <= jobs; idx++ {
+		b.copyNames <- fmt.Sprintf("art-%d", idx)
+	}
+	return b
+}
+
+// prepare creates the clean chroot if it does not exist yet, or updates it
+// otherwise. This is done once per run, before the first build.
+func (b *ChrootBuilder) prepare(output io.Writer) error {
+	b.prepareOnce.Do(func() {
+		rootPath := filepath.Join(b.Path, "root")
+		exists, err := fileExists(rootPath)
+		if err != nil {
+			b.prepareErr = err
+			return
+		}
+
+		var configArgs []string
+		if b.PacmanConfigPath != "" {
+			configArgs = append(configArgs, "-C", b.PacmanConfigPath)
+		}
+		if b.MakepkgConfigPath != "" {
+			configArgs = append(configArgs, "-M", b.MakepkgConfigPath)
+		}
+
+		var cmd *exec.Cmd
+		if exists {
+			args := append(configArgs, rootPath, "pacman", "-Syu", "--noconfirm")
+			cmd = exec.Command("arch-nspawn", args...)
+		} else {
+			err := os.MkdirAll(b.Path, 0755)
+			if err != nil {
+				b.prepareErr = err
+				return
+			}
+			args := append(configArgs, rootPath, "base-devel")
+			cmd = exec.Command("mkarchroot", args...)
+		}
+		cmd.Stdin = nil
+		cmd.Stdout = output
+		cmd.Stderr = output
+		err = cmd.Run()
+		if err != nil {
+			b.prepareErr = fmt.Errorf("cannot prepare chroot at %s: %s", rootPath, err.Error())
+		}
+	})
+	return b.prepareErr
+}
+
+// Build builds the given package inside a working copy of the clean chroot.
+// The opts.DependencyFiles are installed into the working copy before the
+// build.
+func (b *ChrootBuilder) Build(pkg NativePackage, opts BuildOptions) error {
+	err := b.prepare(opts.Output)
+	if err != nil {
+		return err
+	}
+
+	copyName := <-b.copyNames
+	defer func() { b.copyNames <- copyName }()
+
+	//makechrootpkg only understands files called "PKGBUILD" in the current
+	//directory, so "$pkgname.PKGBUILD" needs to be copied into a directory of
+	//its own (together with the local files that it refers to)
+	workDirPath := filepath.Dir(pkg.Path)
+	if filepath.Base(pkg.Path) != "PKGBUILD" {
+		workDirPath, err = ioutil.TempDir("", "art-chroot-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(workDirPath)
+		err = copyInputFiles(pkg, workDirPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"-c", "-r", b.Path, "-l", copyName}
+	for _, path := range opts.DependencyFiles {
+		args = append(args, "-I", path)
+	}
+	cmd := exec.Command("makechrootpkg", args...)
+	cmd.Dir = workDirPath
+	cmd.Stdin = nil
+	cmd.Stdout = opts.Output
+	cmd.Stderr = opts.Output
+	cmd.Env = append(os.Environ(),
+		"PKGDEST="+opts.DestDirPath,
+	)
+	return cmd.Run()
+}
+
+// copyInputFiles copies the PKGBUILD of the given package into the given
+// directory (as "PKGBUILD"), together with all local files that it refers to
+// (sources, install scripts, changelogs).
+func copyInputFiles(pkg NativePackage, workDirPath string) error {
+	inputFiles, err := pkg.InputFiles()
+	if err != nil {
+		return err
+	}
+	dirPath := filepath.Dir(pkg.Path)
+	for _, path := range inputFiles {
+		var relPath string
+		if path == pkg.Path {
+			relPath = "PKGBUILD"
+		} else {
+			relPath, err = filepath.Rel(dirPath, path)
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				relPath = filepath.Base(path)
+			}
+		}
+		err := copyFile(path, filepath.Join(workDirPath, relPath))
+		//missing files are reported by makepkg
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file at `srcPath` to `destPath`, creating the parent
+// directories of `destPath` if necessary.
+func copyFile(srcPath, destPath string) error {
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(destPath), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(destPath, buf, fi.Mode().Perm())
+}
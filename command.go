@@ -0,0 +1,602 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Command is a subcommand of art, e.g. "art build".
+type Command struct {
+	Name        string
+	Arguments   string
+	Description string
+	//AddFlags registers the command-specific flags (may be nil).
+	AddFlags func(fs *flag.FlagSet)
+	//Run executes the command with the positional arguments that remain after
+	//flag parsing. It returns the exit code.
+	Run func(args []string) int
+}
+
+// This is filled in init() to avoid an initialization cycle between
+// `commands` and `cmdHelp` (which refers to `commands`).
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{
+			Name:        "run",
+			Arguments:   "[<package>...]",
+			Description: "Build, sign and publish all packages (or only the given ones), then prune (default).",
+			AddFlags: func(fs *flag.FlagSet) {
+				addBuildFlags(fs)
+				addSelectFlags(fs)
+				addSignFlags(fs)
+				addDryRunFlag(fs)
+				addReportFlags(fs)
+			},
+			Run: cmdRun,
+		},
+		{
+			Name:        "build",
+			Arguments:   "[<package>...]",
+			Description: "Build all packages (or only the given ones) whose output files are missing from the target directory.",
+			AddFlags: func(fs *flag.FlagSet) {
+				addBuildFlags(fs)
+				addSelectFlags(fs)
+				addDryRunFlag(fs)
+				addReportFlags(fs)
+			},
+			Run: cmdBuild,
+		},
+		{
+			Name:        "rebuild",
+			Arguments:   "<package>...",
+			Description: "Rebuild the given packages even if they are up to date, then sign, publish and prune like `art run`.",
+			AddFlags: func(fs *flag.FlagSet) {
+				addBuildFlags(fs)
+				addSelectFlags(fs)
+				addRebuildFlags(fs)
+				addSignFlags(fs)
+				addDryRunFlag(fs)
+				addReportFlags(fs)
+			},
+			Run: cmdRebuild,
+		},
+		{
+			Name:        "sign",
+			Description: "Add signatures to all output files that do not have one yet.",
+			AddFlags:    func(fs *flag.FlagSet) { addSignFlags(fs); addDryRunFlag(fs) },
+			Run:         cmdSign,
+		},
+		{
+			Name:        "verify",
+			Description: "Verify all signatures of output files and repository metadata.",
+			AddFlags:    addSignFlags,
+			Run:         cmdVerify,
+		},
+		{
+			Name:        "check-rebuilds",
+			Description: "Report packages that link against shared libraries that are not available anymore.",
+			Run:         cmdCheckRebuilds,
+		},
+		{
+			Name:        "publish",
+			Description: "Add new and changed output files to the repository metadata.",
+			AddFlags:    addDryRunFlag,
+			Run:         cmdPublish,
+		},
+		{
+			Name:        "prune",
+			Description: "Remove old entries from the repository metadata and old files from the target directory.",
+			AddFlags:    addDryRunFlag,
+			Run:         cmdPrune,
+		},
+		{
+			Name:        "rollback",
+			Arguments:   "<pkgname>",
+			Description: "Replace the current version of a package in the repository metadata with an archived version.",
+			AddFlags:    addRollbackFlags,
+			Run:         cmdRollback,
+		},
+		{
+			Name:        "status",
+			Description: "Show which output files are built, signed and published, and which files are orphaned.",
+			AddFlags:    addStatusFlags,
+			Run:         cmdStatus,
+		},
+		{
+			Name:        "list",
+			Description: "List all discovered packages and their output files.",
+			Run:         cmdList,
+		},
+		{
+			Name:        "help",
+			Arguments:   "[<command>]",
+			Description: "Show usage information for art or for the given command.",
+			Run:         cmdHelp,
+		},
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Execute parses the flags for this command and runs it.
+func (cmd *Command) Execute(args []string) int {
+	fs := flag.NewFlagSet("art "+cmd.Name, flag.ContinueOnError)
+	fs.Usage = func() { cmd.printUsage(fs.Output()) }
+	if cmd.AddFlags != nil {
+		cmd.AddFlags(fs)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if cmd.Arguments == "" && fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "art %s: unexpected argument: %q\n", cmd.Name, fs.Arg(0))
+		cmd.printUsage(fs.Output())
+		return 2
+	}
+	return cmd.Run(fs.Args())
+}
+
+func (cmd *Command) printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s\n\n", strings.TrimSpace("art "+cmd.Name+" [options] "+cmd.Arguments))
+	fmt.Fprintf(w, "%s\n", cmd.Description)
+
+	fs := flag.NewFlagSet("art "+cmd.Name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	if cmd.AddFlags != nil {
+		cmd.AddFlags(fs)
+	}
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintf(w, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+}
+
+func printGeneralUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: art [<command>] [options] [<args>...]\n\nCommands:\n")
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.Name) > width {
+			width = len(cmd.Name)
+		}
+	}
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-*s %s\n", width, cmd.Name, cmd.Description)
+	}
+	fmt.Fprintf(w, "\nRun \"art help <command>\" for details on a specific command.\n")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// flags
+
+var (
+	flagJobs    uint
+	flagVerbose bool
+)
+
+func addBuildFlags(fs *flag.FlagSet) {
+	fs.UintVar(&flagJobs, "j", 0, "build up to `N` packages in parallel (overrides \"jobs\" in art.toml)")
+	fs.BoolVar(&flagVerbose, "verbose", false, "show the output of builds on the terminal (in addition to the build logs)")
+}
+
+var flagWithDeps bool
+
+func addSelectFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&flagWithDeps, "with-deps", false, "when packages are given, also build their dependencies from the same configuration")
+}
+
+var flagBumpPkgrel bool
+
+func addRebuildFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&flagBumpPkgrel, "bump-pkgrel", false, "increment pkgrel (or the release of holo-build packages) before rebuilding")
+}
+
+var flagResign bool
+
+func addSignFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&flagResign, "resign", false, "replace invalid signatures with new ones made with the current key")
+}
+
+var flagDryRun bool
+
+func addDryRunFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&flagDryRun, "dry-run", false, "only show what would be done, without building, signing or changing any files")
+}
+
+var (
+	flagReportJSON  string
+	flagReportJUnit string
+)
+
+func addReportFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagReportJSON, "report-json", "", "write a summary of the run into this `FILE` as JSON")
+	fs.StringVar(&flagReportJUnit, "report-junit", "", "write a summary of the run into this `FILE` as JUnit XML")
+}
+
+var flagStatusJSON bool
+
+func addStatusFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&flagStatusJSON, "json", false, "print the status as JSON instead of a table")
+}
+
+var (
+	flagRollbackVersion string
+	flagRollbackTarget  string
+)
+
+func addRollbackFlags(fs *flag.FlagSet) {
+	fs.StringVar(&flagRollbackVersion, "version", "", "restore this `VERSION` (default: the newest archived version older than the current one)")
+	fs.StringVar(&flagRollbackTarget, "target", "", "only consider the target with this `NAME`")
+}
+
+// applyFlags merges the values of command-line flags into the configuration.
+func (s *Session) applyFlags() {
+	if flagJobs > 0 {
+		s.Config.Jobs = flagJobs
+	}
+	s.Verbose = flagVerbose
+	s.Resign = flagResign
+	if flagDryRun {
+		s.DryRun = newDryRun()
+	}
+	if flagStatusJSON {
+		//keep stdout clean for the JSON document
+		s.UI.Output = os.Stderr
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// command implementations
+
+func cmdRun(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	if len(args) > 0 && !s.selectPackages(args, flagWithDeps) {
+		return 1
+	}
+	defer s.DryRun.Print()
+	s.startReport(flagReportJSON, flagReportJUnit)
+	ok = s.runAllPhases()
+	if !s.Report.Finish(s.UI) || !ok {
+		return 1
+	}
+	return 0
+}
+
+func cmdRebuild(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "art rebuild: expected at least one package name\n")
+		return 2
+	}
+
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	if !s.selectPackages(args, flagWithDeps) {
+		return 1
+	}
+	defer s.DryRun.Print()
+	s.ForceRebuild = true
+	if flagBumpPkgrel && !s.bumpReleases() {
+		return 1
+	}
+	s.startReport(flagReportJSON, flagReportJUnit)
+	ok = s.runAllPhases()
+	if !s.Report.Finish(s.UI) || !ok {
+		return 1
+	}
+	return 0
+}
+
+// runAllPhases builds, signs, publishes and prunes.
+func (s *Session) runAllPhases() bool {
+	if !s.buildPackages() {
+		return false
+	}
+	allOutputFiles, ok := s.signPackages()
+	if !ok {
+		return false
+	}
+	return s.publishPackages(allOutputFiles) && s.prune(allOutputFiles)
+}
+
+func cmdBuild(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	if len(args) > 0 && !s.selectPackages(args, flagWithDeps) {
+		return 1
+	}
+	defer s.DryRun.Print()
+	s.startReport(flagReportJSON, flagReportJUnit)
+	ok = s.buildPackages()
+	if !s.Report.Finish(s.UI) || !ok {
+		return 1
+	}
+	return 0
+}
+
+func cmdSign(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	defer s.DryRun.Print()
+	_, ok = s.signPackages()
+	if !s.writeCache() || !ok {
+		return 1
+	}
+	return 0
+}
+
+func cmdVerify(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	allOutputFiles, ok := s.collectOutputFiles()
+	if !s.writeCache() || !ok {
+		return 1
+	}
+	if !s.verifySignatures(allOutputFiles) {
+		return 1
+	}
+	return 0
+}
+
+func cmdCheckRebuilds(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	candidates, ok := s.checkRebuilds()
+	if !s.writeCache() {
+		ok = false
+	}
+
+	var names []string
+	isName := make(map[string]bool)
+	for _, c := range candidates {
+		fmt.Printf("%s: missing %s\n", filepath.Join(c.Target.Path, c.FileName), strings.Join(c.MissingLibraries, ", "))
+		name, _, isValid := parsePackageFileName(c.FileName)
+		if isValid && !isName[name] {
+			names = append(names, name)
+			isName[name] = true
+		}
+	}
+	if len(candidates) == 0 {
+		if !ok {
+			return 1
+		}
+		fmt.Println("No packages need to be rebuilt.")
+		return 0
+	}
+	fmt.Printf("\nTo rebuild these packages, run: art rebuild -bump-pkgrel %s\n", strings.Join(names, " "))
+	return 1
+}
+
+func cmdPublish(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	defer s.DryRun.Print()
+	allOutputFiles, ok := s.collectOutputFiles()
+	if !ok {
+		return 1
+	}
+	if !s.publishPackages(allOutputFiles) {
+		return 1
+	}
+	return 0
+}
+
+func cmdPrune(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	defer s.DryRun.Print()
+	allOutputFiles, ok := s.collectOutputFiles()
+	if !s.writeCache() || !ok {
+		return 1
+	}
+	if !s.prune(allOutputFiles) {
+		return 1
+	}
+	return 0
+}
+
+func cmdRollback(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "art rollback: expected exactly one package name\n")
+		return 2
+	}
+	pkgName := args[0]
+
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+
+	exitCode := 0
+	found := false
+	checkedTargets := 0
+	var disabledTargets []string
+	for _, target := range s.Config.Targets {
+		if flagRollbackTarget != "" && target.Name != flagRollbackTarget {
+			continue
+		}
+		if target.KeepVersions == 0 {
+			disabledTargets = append(disabledTargets, target.DisplayName())
+			continue
+		}
+		pkg, entry, err := s.findPackageByName(target, pkgName)
+		if err != nil {
+			s.UI.ShowError(err)
+			exitCode = 1
+			continue
+		}
+		if pkg == nil {
+			continue //not built for this target
+		}
+		checkedTargets++
+		fileName, err := target.rollbackPackage(pkgName, flagRollbackVersion)
+		if err != nil {
+			s.UI.ShowError(err)
+			exitCode = 1
+			continue
+		}
+		if fileName == "" {
+			continue
+		}
+		found = true
+		fmt.Printf("restored %s\n", filepath.Join(target.Path, fileName))
+		s.Cache.SetPin(target, pkgName, PinnedCacheEntry{
+			CacheKey:    pkg.CacheKey(),
+			ContentHash: entry.ContentHash,
+			FileName:    fileName,
+		})
+		if !target.signDatabases(s.Signer, s.UI) {
+			exitCode = 1
+		}
+	}
+	if !s.writeCache() {
+		exitCode = 1
+	}
+
+	if found {
+		fmt.Printf("%s will not be rebuilt until its package definition is changed\n", pkgName)
+	}
+	if !found && exitCode == 0 {
+		if len(disabledTargets) > 0 {
+			s.UI.ShowError(fmt.Errorf("cannot roll back %s in %s: archiving is disabled (keep_versions = 0)", pkgName, strings.Join(disabledTargets, ", ")))
+		}
+		switch {
+		case checkedTargets == 0 && len(disabledTargets) > 0:
+			//error was already reported
+		case checkedTargets == 0:
+			s.UI.ShowError(fmt.Errorf("no package named %s found", pkgName))
+		case flagRollbackVersion == "":
+			s.UI.ShowError(fmt.Errorf("no archived version of %s found that is older than the current version", pkgName))
+		default:
+			s.UI.ShowError(fmt.Errorf("version %s of %s not found in archive", flagRollbackVersion, pkgName))
+		}
+		return 1
+	}
+	return exitCode
+}
+
+func cmdStatus(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+	entries, ok := s.collectStatus()
+	if !s.writeCache() || !ok {
+		return 1
+	}
+
+	var err error
+	if flagStatusJSON {
+		err = printStatusJSON(os.Stdout, entries)
+	} else {
+		err = printStatusTable(os.Stdout, entries, len(s.Config.Targets) > 1)
+	}
+	if err != nil {
+		s.UI.ShowError(err)
+		return 1
+	}
+	return 0
+}
+
+func cmdList(args []string) int {
+	s, ok := newSession()
+	if !ok || !s.discoverPackages() {
+		return 1
+	}
+
+	exitCode := 0
+	for _, src := range s.Config.Sources {
+		for _, pkg := range src.Packages {
+			entry, err := s.Cache.GetEntryForPackage(pkg)
+			if err != nil {
+				s.UI.ShowError(err)
+				exitCode = 1
+				continue
+			}
+			if len(s.Config.Targets) > 1 {
+				fmt.Printf("%s (target: %s)\n", pkg.CacheKey(), src.Target.Name)
+			} else {
+				fmt.Println(pkg.CacheKey())
+			}
+			for _, fileName := range entry.OutputFiles {
+				fmt.Printf("  %s\n", fileName)
+			}
+		}
+	}
+	if !s.writeCache() {
+		return 1
+	}
+	return exitCode
+}
+
+func cmdHelp(args []string) int {
+	switch len(args) {
+	case 0:
+		printGeneralUsage(os.Stdout)
+		return 0
+	case 1:
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "art help: unknown command: %q\n", args[0])
+			return 2
+		}
+		cmd.printUsage(os.Stdout)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "art help: expected at most one argument\n")
+		return 2
+	}
+}
@@ -0,0 +1,204 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression identifies a compression format for tar archives.
+type Compression string
+
+// Supported values for Compression. The string values are the file name
+// suffixes that follow ".tar" (or the empty string for uncompressed archives).
+const (
+	CompressionNone  Compression = ""
+	CompressionGzip  Compression = ".gz"
+	CompressionBzip2 Compression = ".bz2"
+	CompressionXZ    Compression = ".xz"
+	CompressionZstd  Compression = ".zst"
+)
+
+// compressionByConfigName maps values for the `db_compression` option in
+// art.toml to Compression values.
+var compressionByConfigName = map[string]Compression{
+	"none": CompressionNone,
+	"gz":   CompressionGzip,
+	"bz2":  CompressionBzip2,
+	"xz":   CompressionXZ,
+	"zst":  CompressionZstd,
+}
+
+var compressionMagics = []struct {
+	Magic       []byte
+	Compression Compression
+}{
+	{[]byte{0x1F, 0x8B}, CompressionGzip},
+	{[]byte("BZh"), CompressionBzip2},
+	{[]byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, CompressionXZ},
+	{[]byte{0x28, 0xB5, 0x2F, 0xFD}, CompressionZstd},
+}
+
+// detectCompression identifies the compression format from the first bytes
+// of a file. Everything that is not recognized is assumed to be uncompressed.
+func detectCompression(header []byte) Compression {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(header, m.Magic) {
+			return m.Compression
+		}
+	}
+	return CompressionNone
+}
+
+// openDecompressed opens the file at the given path, and returns a reader for
+// its decompressed contents. The compression format is detected from the file
+// contents, not from the file name.
+func openDecompressed(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(file)
+	header, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, err
+	}
+
+	switch detectCompression(header) {
+	case CompressionGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %s", path, err.Error())
+		}
+		return readCloser{gr, file}, nil
+	case CompressionBzip2:
+		return readCloser{bzip2.NewReader(br), file}, nil
+	case CompressionXZ:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %s", path, err.Error())
+		}
+		return readCloser{xr, file}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %s", path, err.Error())
+		}
+		return zstdReadCloser{zr, file}, nil
+	default:
+		return readCloser{br, file}, nil
+	}
+}
+
+// readCloser combines a Reader with the Closer for the underlying file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// zstdReadCloser is like readCloser, but also releases the resources of the
+// zstd decoder.
+type zstdReadCloser struct {
+	*zstd.Decoder
+	file *os.File
+}
+
+// Close implements the io.Closer interface.
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.file.Close()
+}
+
+// newCompressedWriter returns a writer that compresses everything written to
+// it in the given format, and writes the result into `w`. The caller must
+// Close() the returned writer to flush all output; `w` itself is not closed.
+func newCompressedWriter(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionBzip2:
+		//neither the Go standard library nor our dependencies have an encoder
+		//for this format
+		return newCompressedWriterWith(w, "bzip2", "--compress", "--stdout")
+	case CompressionXZ:
+		return xz.NewWriter(w)
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression format: %q", string(compression))
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements the io.Closer interface.
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newCompressedWriterWith pipes the written data through an external
+// compression program.
+func newCompressedWriterWith(w io.Writer, command string, args ...string) (io.WriteCloser, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cannot compress with %s: %s", command, err.Error())
+	}
+	return &commandWriter{stdin, cmd}, nil
+}
+
+// commandWriter writes into the input of an external compression program.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close implements the io.Closer interface.
+func (w *commandWriter) Close() error {
+	err := w.WriteCloser.Close()
+	waitErr := w.cmd.Wait()
+	if err == nil && waitErr != nil {
+		err = fmt.Errorf("cannot compress with %s: %s", w.cmd.Path, waitErr.Error())
+	}
+	return err
+}
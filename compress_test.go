@@ -0,0 +1,118 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testCompressionTools = map[Compression]string{
+	CompressionGzip:  "gzip",
+	CompressionBzip2: "bzip2",
+	CompressionXZ:    "xz",
+	CompressionZstd:  "zstd",
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	contents := []byte(strings.Repeat("%NAME%\nfoo\n\n%VERSION%\n1.0-1\n\n", 1000))
+
+	for configName, compression := range compressionByConfigName {
+		//write with our own compressor, read back with our own decompressor
+		path := filepath.Join(dirPath, "test.db.tar"+string(compression))
+		var buf bytes.Buffer
+		w, err := newCompressedWriter(&buf, compression)
+		if err == nil {
+			_, err = w.Write(contents)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			t.Errorf("cannot compress with %s: %s", configName, err.Error())
+			continue
+		}
+		err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := detectCompression(buf.Bytes()); actual != compression {
+			t.Errorf("expected %s output to be detected as %q, got %q", configName, compression, actual)
+		}
+		expectDecompressed(t, path, contents)
+
+		//the output must be readable by the reference implementation, and
+		//vice versa
+		tool := testCompressionTools[compression]
+		if tool == "" {
+			continue
+		}
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Logf("skipping compatibility check for %s: %s not installed", configName, tool)
+			continue
+		}
+		out, err := exec.Command(tool, "--decompress", "--stdout", path).Output()
+		if err != nil {
+			t.Errorf("%s cannot decompress our output: %s", tool, err.Error())
+		} else if !bytes.Equal(out, contents) {
+			t.Errorf("%s decompressed our output incorrectly", tool)
+		}
+		cmd := exec.Command(tool, "--stdout")
+		cmd.Stdin = bytes.NewReader(contents)
+		out, err = cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, out, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDecompressed(t, path, contents)
+	}
+}
+
+func expectDecompressed(t *testing.T, path string, expected []byte) {
+	t.Helper()
+	r, err := openDecompressed(path)
+	if err != nil {
+		t.Errorf("cannot open %s: %s", path, err.Error())
+		return
+	}
+	actual, err := ioutil.ReadAll(r)
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		t.Errorf("cannot read %s: %s", path, err.Error())
+		return
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %s to decompress to the original contents", path)
+	}
+}
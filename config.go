@@ -22,14 +22,23 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	toml "github.com/BurntSushi/toml"
 )
 
 // Configuration is the contents of the configuration file.
 type Configuration struct {
-	Sources []*Source  `toml:"source"`
-	Target  Repository `toml:"target"`
+	Sources []*Source `toml:"source"`
+	//Targets is filled from either a single [target] section or from multiple
+	//[[target]] sections.
+	Targets []*Repository `toml:"-"`
+	//Jobs is the number of packages that are built in parallel.
+	Jobs    uint          `toml:"jobs"`
+	Chroot  ChrootConfig  `toml:"chroot"`
+	Signing SigningConfig `toml:"signing"`
+	Logs    LogConfig     `toml:"logs"`
 }
 
 func readConfig() (*Configuration, error) {
@@ -38,26 +47,186 @@ func readConfig() (*Configuration, error) {
 		return nil, err
 	}
 
-	var cfg Configuration
-	err = toml.Unmarshal(bytes, &cfg)
+	var data struct {
+		Configuration
+		Target toml.Primitive `toml:"target"`
+	}
+	md, err := toml.Decode(string(bytes), &data)
 	if err != nil {
 		return nil, err
 	}
+	cfg := data.Configuration
 
-	if cfg.Target.Path == "" {
-		return nil, errors.New("parse art.toml: missing value for target.path")
+	//the target can be given either as [target] or as one or more [[target]]
+	if !md.IsDefined("target") {
+		return nil, errors.New("parse art.toml: no target specified")
+	}
+	targetKey := func(idx int) string { return "target" }
+	err = md.PrimitiveDecode(data.Target, &cfg.Targets)
+	if err == nil {
+		targetKey = func(idx int) string { return fmt.Sprintf("targets[%d]", idx) }
+	} else {
+		var target Repository
+		err := md.PrimitiveDecode(data.Target, &target)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Targets = []*Repository{&target}
 	}
-	if cfg.Target.Name == "" {
-		return nil, errors.New("parse art.toml: missing value for target.name")
+
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("parse art.toml: no target specified")
 	}
+	targetsByName := make(map[string]*Repository, len(cfg.Targets))
+	isTargetPath := make(map[string]bool, len(cfg.Targets))
+	for idx, target := range cfg.Targets {
+		if target.Path == "" {
+			return nil, fmt.Errorf("parse art.toml: missing value for %s.path", targetKey(idx))
+		}
+		if target.Name == "" {
+			return nil, fmt.Errorf("parse art.toml: missing value for %s.name", targetKey(idx))
+		}
+		if targetsByName[target.Name] != nil {
+			return nil, fmt.Errorf("parse art.toml: duplicate target name %q", target.Name)
+		}
+		targetsByName[target.Name] = target
+		if isTargetPath[filepath.Clean(target.Path)] {
+			return nil, fmt.Errorf("parse art.toml: multiple targets with path %q", target.Path)
+		}
+		isTargetPath[filepath.Clean(target.Path)] = true
+		err = validateBuilder(targetKey(idx)+".builder", target.Builder)
+		if err != nil {
+			return nil, err
+		}
+		if target.DBCompression != "" {
+			if _, exists := compressionByConfigName[target.DBCompression]; !exists {
+				return nil, fmt.Errorf("parse art.toml: invalid value for %s.db_compression: %q", targetKey(idx), target.DBCompression)
+			}
+		}
+		switch target.DBTool {
+		case "", DBToolBuiltin, DBToolRepoAdd:
+		default:
+			return nil, fmt.Errorf("parse art.toml: invalid value for %s.db_tool: %q (expected %q or %q)", targetKey(idx), target.DBTool, DBToolBuiltin, DBToolRepoAdd)
+		}
+		isArch := make(map[string]bool, len(target.Architectures))
+		for _, arch := range target.Architectures {
+			if arch == "" || arch == "any" || strings.Contains(arch, "/") || isArch[arch] {
+				return nil, fmt.Errorf("parse art.toml: invalid value for %s.architectures: %q", targetKey(idx), arch)
+			}
+			isArch[arch] = true
+		}
+	}
+
 	if len(cfg.Sources) == 0 {
 		return nil, errors.New("parse art.toml: no sources specified")
 	}
+	chrootArchs := make(map[string]bool) //the empty string stands for the host architecture
+	usesChroot := false
 	for idx, src := range cfg.Sources {
 		if src.Path == "" {
 			return nil, fmt.Errorf("parse art.toml: missing value for sources[%d].path", idx)
 		}
+		switch {
+		case src.TargetName != "":
+			src.Target = targetsByName[src.TargetName]
+			if src.Target == nil {
+				return nil, fmt.Errorf("parse art.toml: sources[%d].target refers to unknown target %q", idx, src.TargetName)
+			}
+		case len(cfg.Targets) == 1:
+			src.Target = cfg.Targets[0]
+		default:
+			return nil, fmt.Errorf("parse art.toml: missing value for sources[%d].target (required when there are multiple targets)", idx)
+		}
+		err := validateBuilder(fmt.Sprintf("sources[%d].builder", idx), src.Builder)
+		if err != nil {
+			return nil, err
+		}
+		if src.Builder == "" {
+			src.Builder = src.Target.Builder
+		}
+		if src.Builder == BuilderChroot {
+			usesChroot = true
+			if len(src.Target.Architectures) == 0 {
+				chrootArchs[""] = true
+			}
+			for _, arch := range src.Target.Architectures {
+				chrootArchs[arch] = true
+			}
+		}
+	}
+	if usesChroot && cfg.Chroot.Path == "" {
+		return nil, errors.New("parse art.toml: missing value for chroot.path (required for builder = \"chroot\")")
+	}
+	if len(chrootArchs) > 1 && !strings.Contains(cfg.Chroot.Path, "$arch") {
+		return nil, errors.New("parse art.toml: chroot.path must contain \"$arch\" when building for multiple architectures in a chroot")
+	}
+
+	err = cfg.Signing.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.expandArchitectures()
+
+	if cfg.Jobs == 0 {
+		cfg.Jobs = 1
+	}
+	if cfg.Logs.Path == "" {
+		cfg.Logs.Path = defaultLogPath
+	}
+	if cfg.Logs.Keep == 0 {
+		cfg.Logs.Keep = defaultKeepLogs
 	}
 
 	return &cfg, nil
 }
+
+// expandArchitectures replaces each target with multiple architectures by one
+// Repository per architecture, and each source going into such a target by
+// one Source per architecture.
+func (cfg *Configuration) expandArchitectures() {
+	var targets []*Repository
+	reposForTarget := make(map[*Repository][]*Repository)
+	for _, target := range cfg.Targets {
+		if len(target.Architectures) == 0 {
+			targets = append(targets, target)
+			continue
+		}
+		for _, arch := range target.Architectures {
+			repo := *target
+			repo.Path = filepath.Join(target.Path, "os", arch)
+			repo.Architecture = arch
+			if len(reposForTarget[target]) > 0 {
+				repo.AnyPackagesFrom = reposForTarget[target][0]
+			}
+			reposForTarget[target] = append(reposForTarget[target], &repo)
+			targets = append(targets, &repo)
+		}
+	}
+
+	var sources []*Source
+	for _, src := range cfg.Sources {
+		repos := reposForTarget[src.Target]
+		if len(repos) == 0 {
+			sources = append(sources, src)
+			continue
+		}
+		for _, repo := range repos {
+			s := *src
+			s.Target = repo
+			sources = append(sources, &s)
+		}
+	}
+
+	cfg.Targets = targets
+	cfg.Sources = sources
+}
+
+func validateBuilder(key, value string) error {
+	switch value {
+	case "", BuilderHost, BuilderChroot:
+		return nil
+	default:
+		return fmt.Errorf("parse art.toml: invalid value for %s: %q (expected %q or %q)", key, value, BuilderHost, BuilderChroot)
+	}
+}
@@ -0,0 +1,224 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BuildNode is a node in the dependency graph between the packages that are
+// built in one run.
+type BuildNode struct {
+	//Index is the position of the package in discovery order. When multiple
+	//packages are ready to be built, the one with the lowest index goes first.
+	Index        int
+	Package      Package
+	Target       *Repository
+	Entry        PackageCacheEntry
+	Dependencies []*BuildNode
+	Dependents   []*BuildNode
+}
+
+// Name returns a human-readable name for this package.
+func (n *BuildNode) Name() string {
+	if len(n.Entry.Relations.Names) == 0 {
+		return n.Package.CacheKey()
+	}
+	if n.Target.Architecture != "" {
+		return n.Entry.Relations.Names[0] + " (" + n.Target.Architecture + ")"
+	}
+	return n.Entry.Relations.Names[0]
+}
+
+// WorkDir returns the directory where makepkg downloads the sources and
+// creates $srcdir and $pkgdir when building this package, or "" for packages
+// that are not built with makepkg. Packages with the same WorkDir (e.g.
+// multiple "*.PKGBUILD" files in one source directory, or the same PKGBUILD
+// for multiple architectures) must not be built at the same time.
+func (n *BuildNode) WorkDir() string {
+	if _, ok := n.Package.(*NativePackage); ok {
+		return filepath.Dir(n.Package.DefinitionPath())
+	}
+	return ""
+}
+
+// buildDependencyGraph connects the packages from the given sources along
+// their dependencies. Only dependencies between packages going into the same
+// target are considered. Dependencies on packages that are not in the given
+// sources (i.e. that come from the system repositories) are ignored. An error
+// is returned if the dependencies contain a cycle.
+func buildDependencyGraph(sources []*Source, c *Cache) ([]*BuildNode, error) {
+	var nodes []*BuildNode
+	providers := make(map[*Repository]map[string][]*BuildNode)
+	for _, src := range sources {
+		if providers[src.Target] == nil {
+			providers[src.Target] = make(map[string][]*BuildNode)
+		}
+		for _, pkg := range src.Packages {
+			entry, err := c.GetEntryForPackage(pkg)
+			if err != nil {
+				return nil, err
+			}
+			node := &BuildNode{Index: len(nodes), Package: pkg, Target: src.Target, Entry: entry}
+			nodes = append(nodes, node)
+			for _, name := range entry.Relations.Names {
+				providers[src.Target][name] = append(providers[src.Target][name], node)
+			}
+			for _, name := range entry.Relations.Provides {
+				providers[src.Target][name] = append(providers[src.Target][name], node)
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		isDependency := make(map[*BuildNode]bool)
+		for _, name := range node.Entry.Relations.Depends {
+			for _, dep := range providers[node.Target][name] {
+				//split packages may depend on each other
+				if dep == node || isDependency[dep] {
+					continue
+				}
+				isDependency[dep] = true
+				node.Dependencies = append(node.Dependencies, dep)
+				dep.Dependents = append(dep.Dependents, node)
+			}
+		}
+	}
+	//when a package definition is built for multiple architectures, output
+	//files for architecture "any" are only built by the instance for the first
+	//architecture, so the other instances need to wait for it
+	for _, node := range nodes {
+		if node.Target.AnyPackagesFrom == nil {
+			continue
+		}
+		for _, other := range nodes {
+			if other.Target == node.Target.AnyPackagesFrom && other.Package.DefinitionPath() == node.Package.DefinitionPath() {
+				node.Dependencies = append(node.Dependencies, other)
+				other.Dependents = append(other.Dependents, node)
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		sort.Slice(node.Dependencies, func(i, j int) bool { return node.Dependencies[i].Index < node.Dependencies[j].Index })
+		sort.Slice(node.Dependents, func(i, j int) bool { return node.Dependents[i].Index < node.Dependents[j].Index })
+	}
+
+	cycle := findDependencyCycle(nodes)
+	if cycle != nil {
+		names := make([]string, len(cycle))
+		for idx, node := range cycle {
+			names[idx] = node.Name()
+		}
+		return nil, fmt.Errorf("cannot build packages: dependency cycle detected: %s", strings.Join(names, " -> "))
+	}
+	return nodes, nil
+}
+
+// findDependencyCycle returns a list of nodes forming a dependency cycle (with
+// the first node repeated at the end), or nil if there is no cycle.
+func findDependencyCycle(nodes []*BuildNode) []*BuildNode {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[*BuildNode]int, len(nodes))
+	var stack []*BuildNode
+
+	var visit func(node *BuildNode) []*BuildNode
+	visit = func(node *BuildNode) []*BuildNode {
+		state[node] = inProgress
+		stack = append(stack, node)
+		for _, dep := range node.Dependencies {
+			switch state[dep] {
+			case inProgress:
+				//found a cycle: it goes from `dep` through the top of the stack back to `dep`
+				for idx, n := range stack {
+					if n == dep {
+						return append(append([]*BuildNode(nil), stack[idx:]...), dep)
+					}
+				}
+			case unvisited:
+				cycle := visit(dep)
+				if cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[node] = done
+		return nil
+	}
+
+	for _, node := range nodes {
+		if state[node] == unvisited {
+			cycle := visit(node)
+			if cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// selectBuildNodes returns the nodes whose package names match any of the
+// given glob patterns (see path.Match). If `withDependencies` is true, all
+// nodes that the matching nodes depend on (directly or indirectly) are
+// selected as well. An error is returned if a pattern does not match any node.
+func selectBuildNodes(nodes []*BuildNode, patterns []string, withDependencies bool) (map[*BuildNode]bool, error) {
+	isSelected := make(map[*BuildNode]bool)
+	var visit func(node *BuildNode)
+	visit = func(node *BuildNode) {
+		if isSelected[node] {
+			return
+		}
+		isSelected[node] = true
+		if withDependencies {
+			for _, dep := range node.Dependencies {
+				visit(dep)
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		found := false
+		for _, node := range nodes {
+			for _, name := range node.Entry.Relations.Names {
+				matches, err := path.Match(pattern, name)
+				if err != nil {
+					return nil, fmt.Errorf("invalid package name pattern %q: %s", pattern, err.Error())
+				}
+				if matches {
+					found = true
+					visit(node)
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no package matches %q", pattern)
+		}
+	}
+	return isSelected, nil
+}
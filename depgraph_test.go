@@ -0,0 +1,284 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPackage is a Package whose relations are given directly instead of
+// being read from a package definition.
+type testPackage struct {
+	Name     string
+	Depends  []string
+	Provides []string
+	//Definition defaults to "/src/$Name/PKGBUILD".
+	Definition string
+	Inputs     []string
+	//Fail makes Build() fail. Otherwise, Build() creates empty output files.
+	Fail bool
+}
+
+func (pkg *testPackage) CacheKey() string {
+	return pkg.Name
+}
+
+func (pkg *testPackage) DefinitionPath() string {
+	if pkg.Definition == "" {
+		return filepath.Join("/src", pkg.Name, "PKGBUILD")
+	}
+	return pkg.Definition
+}
+
+func (pkg *testPackage) InputFiles() ([]string, error) {
+	return pkg.Inputs, nil
+}
+
+func (pkg *testPackage) OutputFiles() ([]string, error) {
+	return []string{pkg.Name + "-1.0-1-any.pkg.tar.zst"}, nil
+}
+
+func (pkg *testPackage) OutputSettings() string {
+	return ""
+}
+
+func (pkg *testPackage) Relations() (PackageRelations, error) {
+	return PackageRelations{
+		Names:    []string{pkg.Name},
+		Provides: pkg.Provides,
+		Depends:  pkg.Depends,
+	}, nil
+}
+
+func (pkg *testPackage) Build(opts BuildOptions) error {
+	if pkg.Fail {
+		return errors.New("build failed")
+	}
+	fileNames, err := pkg.OutputFiles()
+	if err != nil {
+		return err
+	}
+	for _, fileName := range fileNames {
+		err := ioutil.WriteFile(filepath.Join(opts.DestDirPath, fileName), nil, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pkg *testPackage) BumpRelease() error {
+	return nil
+}
+
+func newTestCache() *Cache {
+	return &Cache{
+		Packages:    make(map[string]PackageCacheEntry),
+		OutputFiles: make(map[string]OutputCacheEntry),
+	}
+}
+
+// describeGraph renders the dependencies of each node as "name: dep1 dep2".
+func describeGraph(nodes []*BuildNode) []string {
+	result := make([]string, len(nodes))
+	for idx, node := range nodes {
+		deps := make([]string, len(node.Dependencies))
+		for idx, dep := range node.Dependencies {
+			deps[idx] = dep.Name()
+		}
+		result[idx] = strings.TrimSpace(node.Name() + ": " + strings.Join(deps, " "))
+	}
+	return result
+}
+
+func TestBuildDependencyGraph(t *testing.T) {
+	targetA := &Repository{Name: "a", Path: "/repo/a"}
+	targetB := &Repository{Name: "b", Path: "/repo/b"}
+
+	testCases := []struct {
+		Sources  []*Source
+		Expected []string
+		Error    string
+	}{
+		//simple chain, listed in reverse order
+		{
+			Sources: []*Source{{Target: targetA, Packages: []Package{
+				&testPackage{Name: "app", Depends: []string{"lib", "glibc"}},
+				&testPackage{Name: "lib", Depends: []string{"base"}},
+				&testPackage{Name: "base"},
+			}}},
+			Expected: []string{"app: lib", "lib: base", "base:"},
+		},
+		//dependencies on provided names; duplicate edges are collapsed, and
+		//self-dependencies are ignored
+		{
+			Sources: []*Source{{Target: targetA, Packages: []Package{
+				&testPackage{Name: "foo-git", Provides: []string{"foo", "libfoo.so"}},
+				&testPackage{Name: "bar", Depends: []string{"foo", "libfoo.so", "foo-git", "bar"}},
+			}}},
+			Expected: []string{"foo-git:", "bar: foo-git"},
+		},
+		//multiple providers of the same name
+		{
+			Sources: []*Source{{Target: targetA, Packages: []Package{
+				&testPackage{Name: "app", Depends: []string{"sh"}},
+				&testPackage{Name: "dash", Provides: []string{"sh"}},
+				&testPackage{Name: "bash", Provides: []string{"sh"}},
+			}}},
+			Expected: []string{"app: dash bash", "dash:", "bash:"},
+		},
+		//dependencies across targets are ignored
+		{
+			Sources: []*Source{
+				{Target: targetA, Packages: []Package{&testPackage{Name: "lib"}}},
+				{Target: targetB, Packages: []Package{&testPackage{Name: "app", Depends: []string{"lib"}}}},
+			},
+			Expected: []string{"lib:", "app:"},
+		},
+		//cycles are reported with the whole path
+		{
+			Sources: []*Source{{Target: targetA, Packages: []Package{
+				&testPackage{Name: "base"},
+				&testPackage{Name: "one", Depends: []string{"two", "base"}},
+				&testPackage{Name: "two", Depends: []string{"three"}},
+				&testPackage{Name: "three", Depends: []string{"one"}},
+			}}},
+			Error: "cannot build packages: dependency cycle detected: one -> two -> three -> one",
+		},
+		{
+			Sources: []*Source{{Target: targetA, Packages: []Package{
+				&testPackage{Name: "one", Depends: []string{"two"}},
+				&testPackage{Name: "two", Provides: []string{"alt"}, Depends: []string{"one"}},
+			}}},
+			Error: "cannot build packages: dependency cycle detected: one -> two -> one",
+		},
+	}
+
+	for idx, c := range testCases {
+		nodes, err := buildDependencyGraph(c.Sources, newTestCache())
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if errMsg != c.Error {
+			t.Errorf("test case %d: expected error %q, got %q", idx, c.Error, errMsg)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		actual := describeGraph(nodes)
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("test case %d: expected graph %q, got %q", idx, c.Expected, actual)
+		}
+		//Dependents must mirror Dependencies
+		for _, node := range nodes {
+			for _, dep := range node.Dependencies {
+				found := false
+				for _, dependent := range dep.Dependents {
+					found = found || dependent == node
+				}
+				if !found {
+					t.Errorf("test case %d: %s is missing from the Dependents of %s", idx, node.Name(), dep.Name())
+				}
+			}
+		}
+	}
+}
+
+func TestBuildDependencyGraphWithMultipleArchitectures(t *testing.T) {
+	targetX86 := &Repository{Name: "a", Path: "/repo/a/os/x86_64", Architecture: "x86_64"}
+	targetARM := &Repository{Name: "a", Path: "/repo/a/os/aarch64", Architecture: "aarch64", AnyPackagesFrom: targetX86}
+
+	//the aarch64 instance of each definition waits for the x86_64 instance,
+	//which builds the output files for architecture "any"
+	sources := []*Source{
+		{Target: targetX86, Packages: []Package{
+			&testPackage{Name: "lib-x86_64", Definition: "/src/lib/PKGBUILD"},
+		}},
+		{Target: targetARM, Packages: []Package{
+			&testPackage{Name: "app-aarch64", Definition: "/src/app/PKGBUILD", Depends: []string{"lib-aarch64"}},
+			&testPackage{Name: "lib-aarch64", Definition: "/src/lib/PKGBUILD"},
+		}},
+	}
+	nodes, err := buildDependencyGraph(sources, newTestCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"lib-x86_64 (x86_64):",
+		"app-aarch64 (aarch64): lib-aarch64 (aarch64)",
+		"lib-aarch64 (aarch64): lib-x86_64 (x86_64)",
+	}
+	actual := describeGraph(nodes)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected graph %q, got %q", expected, actual)
+	}
+}
+
+func TestSelectBuildNodes(t *testing.T) {
+	target := &Repository{Name: "a", Path: "/repo/a"}
+	nodes, err := buildDependencyGraph([]*Source{{Target: target, Packages: []Package{
+		&testPackage{Name: "python-app", Depends: []string{"python-lib"}},
+		&testPackage{Name: "python-lib", Depends: []string{"base"}},
+		&testPackage{Name: "base"},
+		&testPackage{Name: "other"},
+	}}}, newTestCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Patterns         []string
+		WithDependencies bool
+		Expected         []string
+		Error            string
+	}{
+		{[]string{"python-app"}, false, []string{"python-app"}, ""},
+		{[]string{"python-app"}, true, []string{"python-app", "python-lib", "base"}, ""},
+		{[]string{"python-*", "other"}, false, []string{"python-app", "python-lib", "other"}, ""},
+		{[]string{"missing"}, false, nil, `no package matches "missing"`},
+		{[]string{"["}, false, nil, `invalid package name pattern "[": syntax error in pattern`},
+	}
+	for _, c := range testCases {
+		selected, err := selectBuildNodes(nodes, c.Patterns, c.WithDependencies)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if errMsg != c.Error {
+			t.Errorf("with patterns %q: expected error %q, got %q", c.Patterns, c.Error, errMsg)
+			continue
+		}
+		var actual []string
+		for _, node := range nodes {
+			if selected[node] {
+				actual = append(actual, node.Name())
+			}
+		}
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("with patterns %q: expected selection %q, got %q", c.Patterns, c.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RepositoryEntry represents an entry for a package in a repo metadata archive.
+type RepositoryEntry struct {
+	PackageName    string
+	PackageBase    string
+	Version        string
+	Description    string
+	Groups         []string
+	FileName       string
+	CompressedSize int64
+	InstalledSize  int64
+	MD5Digest      string
+	SHA256Digest   string
+	//PGPSignature is the base64-encoded detached signature of the package file.
+	PGPSignature string
+	URL          string
+	Licenses     []string
+	Architecture string
+	BuildDate    time.Time
+	Packager     string
+	Replaces     []string
+	Conflicts    []string
+	Provides     []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+	//Files is only filled for entries read from a files database, or from a
+	//package file.
+	Files []string
+	//hasFileList is set by parseDesc when it encounters a %FILES% field.
+	hasFileList bool
+}
+
+// parseDesc parses the contents of a "desc" file from a repo metadata archive
+// into the given entry. Fields that were already filled are overwritten or,
+// for lists, appended to. (This is because older repo metadata archives
+// distribute the fields of one entry over a "desc" and a "depends" file, and
+// files databases have an additional "files" file in the same format.)
+func (entry *RepositoryEntry) parseDesc(buf []byte) error {
+	//read line by line
+	currentField := ""
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
+			currentField = line
+			if line == "%FILES%" {
+				entry.hasFileList = true
+			}
+			continue
+		}
+
+		var err error
+		switch currentField {
+		case "%NAME%":
+			entry.PackageName = line
+		case "%BASE%":
+			entry.PackageBase = line
+		case "%VERSION%":
+			entry.Version = line
+		case "%DESC%":
+			entry.Description = line
+		case "%GROUPS%":
+			entry.Groups = append(entry.Groups, line)
+		case "%FILENAME%":
+			entry.FileName = line
+		case "%CSIZE%":
+			entry.CompressedSize, err = strconv.ParseInt(line, 10, 64)
+		case "%ISIZE%":
+			entry.InstalledSize, err = strconv.ParseInt(line, 10, 64)
+		case "%MD5SUM%":
+			entry.MD5Digest = line
+		case "%SHA256SUM%":
+			entry.SHA256Digest = line
+		case "%PGPSIG%":
+			entry.PGPSignature = line
+		case "%URL%":
+			entry.URL = line
+		case "%LICENSE%":
+			entry.Licenses = append(entry.Licenses, line)
+		case "%ARCH%":
+			entry.Architecture = line
+		case "%BUILDDATE%":
+			var timestamp int64
+			timestamp, err = strconv.ParseInt(line, 10, 64)
+			entry.BuildDate = time.Unix(timestamp, 0).UTC()
+		case "%PACKAGER%":
+			entry.Packager = line
+		case "%REPLACES%":
+			entry.Replaces = append(entry.Replaces, line)
+		case "%CONFLICTS%":
+			entry.Conflicts = append(entry.Conflicts, line)
+		case "%PROVIDES%":
+			entry.Provides = append(entry.Provides, line)
+		case "%DEPENDS%":
+			entry.Depends = append(entry.Depends, line)
+		case "%OPTDEPENDS%":
+			entry.OptDepends = append(entry.OptDepends, line)
+		case "%MAKEDEPENDS%":
+			entry.MakeDepends = append(entry.MakeDepends, line)
+		case "%CHECKDEPENDS%":
+			entry.CheckDepends = append(entry.CheckDepends, line)
+		case "%FILES%":
+			entry.Files = append(entry.Files, line)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", currentField, err.Error())
+		}
+	}
+	return nil
+}
+
+// DirName returns the name of the directory containing this entry in a repo
+// metadata archive.
+func (entry RepositoryEntry) DirName() string {
+	return entry.PackageName + "-" + entry.Version
+}
+
+// formatDesc renders the "desc" file for this entry, with the fields in the
+// same order as repo-add(8) uses.
+func (entry RepositoryEntry) formatDesc() []byte {
+	var buf bytes.Buffer
+	writeField := func(field string, values ...string) {
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			return
+		}
+		fmt.Fprintf(&buf, "%%%s%%\n%s\n\n", field, strings.Join(values, "\n"))
+	}
+	writeField("FILENAME", entry.FileName)
+	writeField("NAME", entry.PackageName)
+	writeField("BASE", entry.PackageBase)
+	writeField("VERSION", entry.Version)
+	writeField("DESC", entry.Description)
+	writeField("GROUPS", entry.Groups...)
+	writeField("CSIZE", strconv.FormatInt(entry.CompressedSize, 10))
+	writeField("ISIZE", strconv.FormatInt(entry.InstalledSize, 10))
+	writeField("MD5SUM", entry.MD5Digest)
+	writeField("SHA256SUM", entry.SHA256Digest)
+	writeField("PGPSIG", entry.PGPSignature)
+	writeField("URL", entry.URL)
+	writeField("LICENSE", entry.Licenses...)
+	writeField("ARCH", entry.Architecture)
+	if !entry.BuildDate.IsZero() {
+		writeField("BUILDDATE", strconv.FormatInt(entry.BuildDate.Unix(), 10))
+	}
+	writeField("PACKAGER", entry.Packager)
+	writeField("REPLACES", entry.Replaces...)
+	writeField("CONFLICTS", entry.Conflicts...)
+	writeField("PROVIDES", entry.Provides...)
+	writeField("DEPENDS", entry.Depends...)
+	writeField("OPTDEPENDS", entry.OptDepends...)
+	writeField("MAKEDEPENDS", entry.MakeDepends...)
+	writeField("CHECKDEPENDS", entry.CheckDepends...)
+	return buf.Bytes()
+}
+
+// formatFiles renders the "files" file for this entry in a files database.
+func (entry RepositoryEntry) formatFiles() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%FILES%\n")
+	for _, file := range entry.Files {
+		buf.WriteString(file)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,300 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DryRun collects the actions that would be taken by a run of ART when the
+// -dry-run flag is given, instead of executing them. It is safe for concurrent
+// use.
+type DryRun struct {
+	actions    []string
+	isReported map[string]bool
+	//isBuilt contains the paths of all output files that would be built.
+	isBuilt map[string]bool
+	//archived contains the names of all package files that would be moved into
+	//the archive directory, keyed by target directory.
+	archived   map[string][]string
+	isArchived map[string]bool
+	mutex      sync.Mutex
+}
+
+func newDryRun() *DryRun {
+	return &DryRun{
+		isReported: make(map[string]bool),
+		isBuilt:    make(map[string]bool),
+		archived:   make(map[string][]string),
+		isArchived: make(map[string]bool),
+	}
+}
+
+// report records an action. Actions that are reported multiple times (e.g.
+// when the removal of an old package file results from both publishing and
+// pruning) are only recorded once.
+func (d *DryRun) report(msg string, args ...interface{}) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	msg = fmt.Sprintf(msg, args...)
+	if !d.isReported[msg] {
+		d.actions = append(d.actions, msg)
+		d.isReported[msg] = true
+	}
+}
+
+// Print prints all recorded actions. It does nothing if `d` is nil, i.e. when
+// not doing a dry run.
+func (d *DryRun) Print() {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.actions) == 0 {
+		fmt.Println("Dry run: nothing to do.")
+		return
+	}
+	fmt.Println("Dry run: the following actions would be taken:")
+	for _, action := range d.actions {
+		fmt.Printf("  %s\n", action)
+	}
+}
+
+// planBuild records that the given package would be built.
+func (d *DryRun) planBuild(pkg Package, targetDirPath string, outputFiles []string) {
+	d.report("build %s", pkg.CacheKey())
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, fileName := range outputFiles {
+		d.isBuilt[filepath.Join(targetDirPath, fileName)] = true
+	}
+}
+
+func (d *DryRun) wouldBeBuilt(path string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.isBuilt[path]
+}
+
+// planSignatures records the signatures that Cache.AddMissingSignatures would
+// add. Existing signatures are verified in the same way, so invalid signatures
+// are reported (or, if `resign` is set, planned to be replaced). Like
+// AddMissingSignatures, it returns the names of all output files of the
+// package.
+func (d *DryRun) planSignatures(c *Cache, pkg Package, targetDirPath string, signer Signer, resign bool) ([]string, error) {
+	entry, err := c.GetEntryForPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return entry.OutputFiles, nil
+	}
+
+	for _, fileName := range entry.OutputFiles {
+		path := filepath.Join(targetDirPath, fileName)
+		if d.wouldBeBuilt(path) {
+			d.report("sign %s", path)
+			continue
+		}
+		exists, err := fileExists(path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		exists, err = fileExists(path + ".sig")
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			d.report("sign %s", path)
+			continue
+		}
+		err = c.VerifySignature(path, signer, false)
+		if err != nil {
+			if !resign {
+				return nil, fmt.Errorf("%s (run `art sign -resign` to replace it)", err.Error())
+			}
+			d.report("sign %s again (%s)", path, err.Error())
+		}
+	}
+	return entry.OutputFiles, nil
+}
+
+// planPublish records the changes that publishing would make to the repository
+// metadata of the given target.
+func (d *DryRun) planPublish(r *Repository, allOutputFiles []string, c *Cache, ui *UI) error {
+	//output files that would be built (or linked) in this run are new in any
+	//case; of the others, only those that have changed are new
+	var newFiles, existingFiles []string
+	for _, fileName := range allOutputFiles {
+		path := filepath.Join(r.Path, fileName)
+		sourcePath := path
+		if r.AnyPackagesFrom != nil && isAnyPackageFile(fileName) {
+			sourcePath = filepath.Join(r.AnyPackagesFrom.Path, fileName)
+		}
+		if d.wouldBeBuilt(sourcePath) {
+			newFiles = append(newFiles, fileName)
+			continue
+		}
+		exists, err := fileExists(path)
+		if err != nil {
+			return err
+		}
+		if exists {
+			existingFiles = append(existingFiles, fileName)
+			continue
+		}
+		if sourcePath != path {
+			exists, err = fileExists(sourcePath)
+			if err != nil {
+				return err
+			}
+			if exists {
+				newFiles = append(newFiles, fileName)
+			}
+		}
+	}
+	ui.SetCurrentTask("Checking repository metadata of "+r.DisplayName(), uint(len(existingFiles)))
+	changedFiles, err := r.findNewPackages(existingFiles, c, ui)
+	ui.EndTask()
+	if err != nil {
+		return err
+	}
+	newFiles = append(newFiles, changedFiles...)
+
+	isNewFile := make(map[string]bool, len(newFiles))
+	isNewPackage := make(map[string]bool, len(newFiles))
+	for _, fileName := range newFiles {
+		d.report("add %s to repository metadata of %s", fileName, r.DisplayName())
+		isNewFile[fileName] = true
+		name, _, ok := parsePackageFileName(fileName)
+		if ok {
+			isNewPackage[name] = true
+		}
+	}
+
+	//entries for previous versions of the new packages are replaced
+	entries, err := r.readMetadata()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if isNewPackage[entry.PackageName] && !isNewFile[entry.FileName] {
+			d.report("remove %s from repository metadata of %s", entry.FileName, r.DisplayName())
+			//with repo-add, old files are only archived by prunePackages()
+			if r.DBTool != DBToolRepoAdd || r.KeepVersions == 0 {
+				d.planDiscard(r, entry.FileName)
+			}
+		}
+	}
+
+	return d.planSignDatabases(r, len(newFiles) > 0)
+}
+
+// planPrune records the changes that pruning would make to the given target.
+func (d *DryRun) planPrune(r *Repository, allOutputFiles []string) error {
+	oldEntries, err := r.findOldEntries(allOutputFiles)
+	if err != nil {
+		return err
+	}
+	for _, entry := range oldEntries {
+		d.report("remove %s from repository metadata of %s", entry.FileName, r.DisplayName())
+	}
+	err = d.planSignDatabases(r, len(oldEntries) > 0)
+	if err != nil {
+		return err
+	}
+
+	fileNames, err := r.findOldPackageFiles(allOutputFiles)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fileName := range fileNames {
+		d.planDiscard(r, fileName)
+	}
+
+	if r.KeepVersions > 0 {
+		d.mutex.Lock()
+		archived := d.archived[r.Path]
+		d.mutex.Unlock()
+		fileNames, err := r.findOldArchivedFiles(archived)
+		if err != nil {
+			return err
+		}
+		for _, fileName := range fileNames {
+			d.report("delete %s", filepath.Join(r.ArchivePath(), fileName))
+		}
+	}
+	return nil
+}
+
+// planDiscard records what Repository.discardPackageFile would do.
+func (d *DryRun) planDiscard(r *Repository, fileName string) {
+	path := filepath.Join(r.Path, fileName)
+	if r.KeepVersions == 0 {
+		d.report("delete %s", path)
+		return
+	}
+	d.report("move %s into %s", path, r.ArchivePath())
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.isArchived[path] {
+		d.archived[r.Path] = append(d.archived[r.Path], fileName)
+		d.isArchived[path] = true
+	}
+}
+
+// planSignDatabases records whether Repository.signDatabases would sign the
+// repository metadata of the given target. If `changed` is true, the metadata
+// would have been rewritten beforehand.
+func (d *DryRun) planSignDatabases(r *Repository, changed bool) error {
+	if !r.SignDB {
+		return nil
+	}
+	if !changed {
+		for _, names := range r.databaseFileNames() {
+			path := filepath.Join(r.Path, names[0])
+			fi, err := os.Stat(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			sigFI, err := os.Stat(path + ".sig")
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err != nil || sigFI.ModTime().Before(fi.ModTime()) {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		d.report("sign repository metadata of %s", r.DisplayName())
+	}
+	return nil
+}
@@ -2,4 +2,8 @@ module github.com/majewsky/art
 
 go 1.18
 
-require github.com/BurntSushi/toml v1.6.0
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/klauspost/compress v1.16.7
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -19,111 +19,759 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 func main() {
-	os.Exit(_main())
+	os.Exit(_main(os.Args[1:]))
 }
 
-func _main() (exitCode int) {
-	ui := &UI{}
+func _main(args []string) int {
+	if len(args) == 0 {
+		return findCommand("run").Execute(nil)
+	}
+
+	switch {
+	case args[0] == "-h" || args[0] == "-help" || args[0] == "--help":
+		printGeneralUsage(os.Stdout)
+		return 0
+	case strings.HasPrefix(args[0], "-"):
+		//options without a command are options for the default command
+		return findCommand("run").Execute(args)
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "art: unknown command: %q\n", args[0])
+		printGeneralUsage(os.Stderr)
+		return 2
+	}
+	return cmd.Execute(args[1:])
+}
 
-	cfg, err := readConfig()
+// Session contains the state that is shared between the phases of a run.
+type Session struct {
+	UI            *UI
+	Config        *Configuration
+	MakepkgConfig MakepkgConfig
+	Cache         *Cache
+	//Signer is nil if signing is not configured.
+	Signer Signer
+	//Resign is set when invalid signatures shall be replaced instead of
+	//reported as errors.
+	Resign bool
+	//DryRun is nil unless the -dry-run flag was given.
+	DryRun *DryRun
+	//Selection is nil unless the run is restricted to some packages (see
+	//selectPackages).
+	Selection *Selection
+	//Verbose is set when the output of builds shall be shown on the terminal
+	//in addition to being written into the build logs.
+	Verbose bool
+	//Report is nil unless a summary shall be shown at the end of the run (see
+	//startReport).
+	Report *Report
+	//ForceRebuild is set by `art rebuild`. All selected packages are then
+	//rebuilt even if their output files exist.
+	ForceRebuild bool
+	//pinnedFiles contains, for each target, the package files that were
+	//restored by `art rollback` and are published instead of the current
+	//output files (key = package name). pinnedPackages contains the
+	//CacheKey() of the packages that are not built because of this. Both are
+	//filled by loadPins.
+	pinnedFiles    map[*Repository]map[string]string
+	pinnedPackages map[string]bool
+}
+
+// Selection is the set of packages that a run is restricted to.
+type Selection struct {
+	//CacheKeys contains the CacheKey() of all selected packages.
+	CacheKeys map[string]bool
+	//PackageNames contains the names of all output files of the selected
+	//packages (as per parsePackageFileName).
+	PackageNames map[string]bool
+}
+
+func newSession() (*Session, bool) {
+	s := &Session{UI: &UI{}}
+
+	var err error
+	s.Config, err = readConfig()
+	if err != nil {
+		s.UI.ShowError(err)
+		return nil, false
+	}
+	s.MakepkgConfig, err = readMakepkgConfig("")
+	if err != nil {
+		s.UI.ShowError(err)
+		return nil, false
+	}
+	s.Cache, err = readCache()
 	if err != nil {
-		ui.ShowError(err)
-		return 1
+		s.UI.ShowError(err)
+		return nil, false
 	}
-	mcfg, err := readMakepkgConfig()
+	s.Signer, err = newSigner(s.Config.Signing, s.MakepkgConfig)
 	if err != nil {
-		ui.ShowError(err)
-		return 1
+		s.UI.ShowError(err)
+		return nil, false
+	}
+	s.applyFlags()
+	return s, true
+}
+
+func (s *Session) packageCount() (count uint) {
+	for _, src := range s.Config.Sources {
+		count += uint(len(src.Packages))
+	}
+	return
+}
+
+func (s *Session) writeCache() bool {
+	if s.DryRun != nil {
+		return true
+	}
+	err := s.Cache.writeCache()
+	s.UI.ShowError(err)
+	return err == nil
+}
+
+func (s *Session) discoverPackages() (ok bool) {
+	s.UI.SetCurrentTask("Discovering packages", uint(len(s.Config.Sources)))
+	defer s.UI.EndTask()
+
+	//the per-architecture subdirectories of multi-architecture targets are
+	//created automatically
+	for _, target := range s.Config.Targets {
+		if target.Architecture != "" && s.DryRun == nil {
+			err := os.MkdirAll(target.Path, 0755)
+			if err != nil {
+				s.UI.ShowError(err)
+				return false
+			}
+		}
+	}
+
+	chroots := make(map[string]*ChrootBuilder)      //key = architecture
+	chrootConfigs := make(map[string]MakepkgConfig) //key = architecture
+	ok = true
+	for _, src := range s.Config.Sources {
+		arch := src.Target.Architecture
+		if arch == "" {
+			arch = s.MakepkgConfig.Architecture
+		}
+
+		var chroot *ChrootBuilder
+		if src.Builder == BuilderChroot {
+			chroot = chroots[arch]
+			if chroot == nil {
+				chroot = NewChrootBuilder(s.Config.Chroot.ForArchitecture(arch), s.Config.Jobs)
+				chroots[arch] = chroot
+			}
+		}
+		if arch != s.MakepkgConfig.Architecture && (chroot == nil || chroot.MakepkgConfigPath == "") {
+			s.UI.ShowError(fmt.Errorf(
+				"cannot build packages from %s for %s on a %s host: need builder = %q and chroot.makepkg_conf",
+				src.Path, arch, s.MakepkgConfig.Architecture, BuilderChroot,
+			))
+			ok = false
+			s.UI.StepTask()
+			continue
+		}
+
+		//when the chroot has its own makepkg.conf, that is what makepkg will use
+		mcfg := s.MakepkgConfig
+		if chroot != nil && chroot.MakepkgConfigPath != "" {
+			var exists bool
+			mcfg, exists = chrootConfigs[arch]
+			if !exists {
+				var err error
+				mcfg, err = readMakepkgConfig(chroot.MakepkgConfigPath)
+				if err == nil && mcfg.Architecture != arch {
+					err = fmt.Errorf("%s sets CARCH=%s, but is used for building packages for %s", chroot.MakepkgConfigPath, mcfg.Architecture, arch)
+				}
+				if err != nil {
+					s.UI.ShowError(err)
+					ok = false
+					s.UI.StepTask()
+					continue
+				}
+				chrootConfigs[arch] = mcfg
+			}
+		}
+
+		err := src.discoverPackages(mcfg, chroot)
+		if err != nil {
+			s.UI.ShowError(err)
+			ok = false
+		}
+		s.UI.StepTask()
 	}
+	return ok && s.loadPins()
+}
 
-	cache, err := readCache()
+// selectPackages restricts this run to the packages whose names match the
+// given patterns (and, if `withDependencies` is set, their dependencies). All
+// other packages are neither built nor signed nor published, and their files
+// are left alone by pruning.
+func (s *Session) selectPackages(patterns []string, withDependencies bool) bool {
+	nodes, err := buildDependencyGraph(s.Config.Sources, s.Cache)
+	if err != nil {
+		s.UI.ShowError(err)
+		return false
+	}
+	selected, err := selectBuildNodes(nodes, patterns, withDependencies)
 	if err != nil {
-		ui.ShowError(err)
-		return 1
+		s.UI.ShowError(err)
+		return false
 	}
 
-	ui.SetCurrentTask("Discovering packages", uint(len(cfg.Sources)))
-	var totalPackageCount uint
-	for _, src := range cfg.Sources {
-		err := src.discoverPackages(mcfg)
+	s.Selection = &Selection{
+		CacheKeys:    make(map[string]bool, len(selected)),
+		PackageNames: make(map[string]bool),
+	}
+	for node := range selected {
+		s.Selection.CacheKeys[node.Package.CacheKey()] = true
+		for _, fileName := range node.Entry.OutputFiles {
+			name, _, ok := parsePackageFileName(fileName)
+			if ok {
+				s.Selection.PackageNames[name] = true
+			}
+		}
+	}
+	return true
+}
+
+func (s *Session) isSelected(pkg Package) bool {
+	return s.Selection == nil || s.Selection.CacheKeys[pkg.CacheKey()]
+}
+
+// selectedOutputFiles returns those of the given output files that belong to
+// the selected packages.
+func (s *Session) selectedOutputFiles(fileNames []string) []string {
+	if s.Selection == nil {
+		return fileNames
+	}
+	var result []string
+	for _, fileName := range fileNames {
+		name, _, ok := parsePackageFileName(fileName)
+		if ok && s.Selection.PackageNames[name] {
+			result = append(result, fileName)
+		}
+	}
+	return result
+}
+
+// filesToKeep returns the given output files of the target, plus all files in
+// the target directory and its repository metadata that belong to packages
+// that are not selected, or whose current output files have not been built
+// yet. These are not touched by pruning.
+func (s *Session) filesToKeep(target *Repository, outputFiles []string) ([]string, error) {
+	//if the current version of a package was not built (e.g. when running `art
+	//prune` after a pkgver bump, or when the build failed), the old version
+	//is kept so that the package does not vanish from the repository
+	isUnbuilt := make(map[string]bool)
+	for _, fileName := range outputFiles {
+		isBuilt, err := s.isOutputFileBuilt(target, fileName)
 		if err != nil {
-			ui.ShowError(err)
-			exitCode = 1
+			return nil, err
+		}
+		name, _, ok := parsePackageFileName(fileName)
+		if ok && !isBuilt {
+			isUnbuilt[name] = true
+		}
+	}
+	if s.Selection == nil && len(isUnbuilt) == 0 {
+		return outputFiles, nil
+	}
+	isKept := make(map[string]bool)
+	mustKeep := func(name string) bool {
+		if isUnbuilt[name] {
+			isKept[name] = true
+			return true
+		}
+		return s.Selection != nil && !s.Selection.PackageNames[name]
+	}
+	result := append([]string(nil), outputFiles...)
+
+	oldEntries, err := target.findOldEntries(outputFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range oldEntries {
+		if mustKeep(entry.PackageName) {
+			result = append(result, entry.FileName)
 		}
-		ui.StepTask()
-		totalPackageCount += uint(len(src.Packages))
 	}
-	ui.EndTask()
 
-	if exitCode > 0 {
-		return
+	fileNames, err := target.findOldPackageFiles(outputFiles)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
+	for _, fileName := range fileNames {
+		name, _, ok := parsePackageFileName(fileName)
+		if (!ok && s.Selection != nil) || (ok && mustKeep(name)) {
+			result = append(result, fileName)
+		}
+	}
+
+	names := make([]string, 0, len(isKept))
+	for name := range isKept {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.UI.ShowWarning("not pruning old versions of %s from %s: the current version has not been built yet", name, target.DisplayName())
+	}
+	return result, nil
+}
+
+// isOutputFileBuilt returns whether the given output file exists in the target
+// directory (or, in a dry run, would be built or linked there in this run).
+func (s *Session) isOutputFileBuilt(target *Repository, fileName string) (bool, error) {
+	path := filepath.Join(target.Path, fileName)
+	if s.DryRun != nil {
+		if s.DryRun.wouldBeBuilt(path) {
+			return true, nil
+		}
+		if target.AnyPackagesFrom != nil && isAnyPackageFile(fileName) && s.DryRun.wouldBeBuilt(filepath.Join(target.AnyPackagesFrom.Path, fileName)) {
+			return true, nil
+		}
+	}
+	return fileExists(path)
+}
 
-	ui.SetCurrentTask("Building packages", totalPackageCount)
-	for _, src := range cfg.Sources {
+// bumpReleases increments the release number in the definitions of all
+// selected packages.
+func (s *Session) bumpReleases() (ok bool) {
+	ok = true
+	isBumped := make(map[string]bool)
+	for _, src := range s.Config.Sources {
 		for _, pkg := range src.Packages {
-			err := cache.Build(pkg, cfg.Target.Path, ui)
+			//multiple instances of a package definition (for multiple
+			//architectures) share the same file
+			path := pkg.DefinitionPath()
+			if !s.isSelected(pkg) || isBumped[path] {
+				continue
+			}
+			isBumped[path] = true
+			if s.DryRun != nil {
+				s.DryRun.report("bump release number in %s", path)
+				continue
+			}
+			err := pkg.BumpRelease()
 			if err != nil {
-				ui.ShowError(err)
-				exitCode = 1
+				s.UI.ShowError(err)
+				ok = false
 			}
-			ui.StepTask()
 		}
 	}
-	ui.EndTask()
+	return
+}
+
+type buildResult struct {
+	Node  *BuildNode
+	Built bool
+	OK    bool
+}
 
-	err = cache.writeCache()
+// buildPackages builds all packages in dependency order, using up to
+// s.Config.Jobs parallel builds. A package is only built once all its
+// dependencies have been built, and it is rebuilt if any of its dependencies
+// was rebuilt.
+func (s *Session) buildPackages() (ok bool) {
+	s.UI.SetCurrentTask("Building packages", s.packageCount())
+
+	nodes, err := buildDependencyGraph(s.Config.Sources, s.Cache)
 	if err != nil {
-		ui.ShowError(err)
-		exitCode = 1
+		s.UI.ShowError(err)
+		s.UI.EndTask()
+		s.writeCache()
+		return false
 	}
 
-	if exitCode > 0 {
-		return
+	var (
+		ready         []*BuildNode
+		pendingCount  = make(map[*BuildNode]int, len(nodes))
+		mustRebuild   = make(map[*BuildNode]bool)
+		failedDep     = make(map[*BuildNode]*BuildNode)
+		results       = make(chan buildResult)
+		runningBuilds uint
+		busyWorkDirs  = make(map[string]bool)
+	)
+	for _, node := range nodes {
+		pendingCount[node] = len(node.Dependencies)
+		if len(node.Dependencies) == 0 {
+			ready = append(ready, node)
+		}
 	}
 
-	ui.SetCurrentTask("Post-processing and signing packages", totalPackageCount)
-	var allOutputFiles []string
-	for _, src := range cfg.Sources {
+	//finish() is called when a package is done (either built, or skipped, or
+	//failed), and releases the dependents of this package
+	ok = true
+	var finish func(r buildResult)
+	finish = func(r buildResult) {
+		s.UI.StepTask()
+		if !r.OK {
+			ok = false
+		}
+		for _, dependent := range r.Node.Dependents {
+			if !r.OK && failedDep[dependent] == nil {
+				failedDep[dependent] = r.Node
+			}
+			if r.Built {
+				mustRebuild[dependent] = true
+			}
+			pendingCount[dependent]--
+			if pendingCount[dependent] > 0 {
+				continue
+			}
+			if dep := failedDep[dependent]; dep != nil {
+				//unselected packages are not built anyway, so they do not fail;
+				//but the failure is passed on to their own dependents
+				if !s.isSelected(dependent.Package) {
+					for _, next := range dependent.Dependents {
+						if failedDep[next] == nil {
+							failedDep[next] = dep
+						}
+					}
+					finish(buildResult{Node: dependent, OK: true})
+					continue
+				}
+				err := fmt.Errorf("not building %s: dependency %s could not be built", dependent.Name(), dep.Name())
+				s.UI.ShowError(err)
+				s.Report.addPackage(dependent, PackageResult{State: PackageFailed, Error: err.Error()})
+				finish(buildResult{Node: dependent})
+				continue
+			}
+			ready = append(ready, dependent)
+		}
+		sort.Slice(ready, func(i, j int) bool { return ready[i].Index < ready[j].Index })
+	}
+
+	for len(ready) > 0 || runningBuilds > 0 {
+		for idx := 0; idx < len(ready) && runningBuilds < s.Config.Jobs; {
+			//packages sharing a working directory are built one after the other
+			node := ready[idx]
+			workDir := node.WorkDir()
+			if workDir != "" && busyWorkDirs[workDir] {
+				idx++
+				continue
+			}
+			ready = append(ready[:idx], ready[idx+1:]...)
+			if workDir != "" {
+				busyWorkDirs[workDir] = true
+			}
+			runningBuilds++
+			go func(node *BuildNode, force bool) {
+				built, ok := s.buildPackage(node, force)
+				results <- buildResult{Node: node, Built: built, OK: ok}
+			}(node, mustRebuild[node] || (s.ForceRebuild && s.isSelected(node.Package)))
+		}
+		r := <-results
+		runningBuilds--
+		delete(busyWorkDirs, r.Node.WorkDir())
+		finish(r)
+	}
+	s.UI.EndTask()
+
+	return s.writeCache() && ok
+}
+
+func (s *Session) buildPackage(node *BuildNode, force bool) (built, ok bool) {
+	if !s.isSelected(node.Package) {
+		return false, true
+	}
+	if s.isPinned(node.Package) {
+		s.UI.ShowInfo("not building %s: it was rolled back, and its package definition has not changed since", node.Name())
+		s.Report.addPackage(node, PackageResult{State: PackageSkipped})
+		return false, true
+	}
+	if s.DryRun != nil {
+		entry, needsBuild, err := s.Cache.NeedsBuild(node.Package, node.Target.Path, s.UI, force)
+		if err == nil && needsBuild {
+			s.DryRun.planBuild(node.Package, node.Target.Path, entry.OutputFiles)
+		}
+		s.UI.ShowError(err)
+		return needsBuild, err == nil
+	}
+
+	log := s.Config.Logs.newBuildLog(node)
+	opts := BuildOptions{DependencyFiles: s.dependencyFiles(node), Output: log}
+
+	//in verbose mode, also show the build output on the terminal: when
+	//building sequentially, stream it directly; otherwise capture it to avoid
+	//interleaving the output of multiple builds
+	var buf bytes.Buffer
+	if s.Verbose {
+		if s.Config.Jobs <= 1 {
+			opts.Output = io.MultiWriter(log, os.Stdout)
+		} else {
+			opts.Output = io.MultiWriter(log, &buf)
+		}
+	}
+
+	built, err := s.Cache.Build(node.Package, node.Target.Path, s.UI, opts, force)
+	if buf.Len() > 0 {
+		s.UI.ShowOutput("Output from building "+node.Package.CacheKey(), buf.Bytes())
+	}
+	logErr := log.Close(built, err)
+	duration := time.Since(log.startTime)
+	result := PackageResult{State: PackageSkipped, DurationSeconds: duration.Seconds()}
+	switch {
+	case err != nil:
+		s.UI.ShowError(fmt.Errorf("cannot build %s: %s (see build log at %s)", node.Name(), err.Error(), log.Path))
+		result.State = PackageFailed
+		result.Error = err.Error()
+		result.LogPath = log.Path
+	case built:
+		s.UI.ShowInfo("built %s in %s", node.Name(), duration.Round(time.Second))
+		result.State = PackageBuilt
+		result.LogPath = log.Path
+	}
+	s.UI.ShowError(logErr)
+
+	if err == nil && s.Report != nil {
+		var entry PackageCacheEntry
+		entry, err = s.Cache.GetEntryForPackage(node.Package)
+		s.UI.ShowError(err)
+		result.OutputFiles = entry.OutputFiles
+	}
+	s.Report.addPackage(node, result)
+	return built, err == nil
+}
+
+// dependencyFiles returns the paths of the output files of all packages that
+// the given package depends on, directly or indirectly. Only output files for
+// the same architecture as the given package (or for "any") are considered.
+func (s *Session) dependencyFiles(node *BuildNode) (result []string) {
+	isVisited := make(map[*BuildNode]bool)
+	var visit func(n *BuildNode)
+	visit = func(n *BuildNode) {
+		for _, dep := range n.Dependencies {
+			if isVisited[dep] {
+				continue
+			}
+			isVisited[dep] = true
+			for _, fileName := range dep.Entry.OutputFiles {
+				if dep.Target == node.Target || isAnyPackageFile(fileName) {
+					result = append(result, filepath.Join(dep.Target.Path, s.pinnedFileName(dep.Target, fileName)))
+				}
+			}
+			visit(dep)
+		}
+	}
+	visit(node)
+	return
+}
+
+// signPackages adds missing signatures and returns the list of all output
+// files for each target.
+func (s *Session) signPackages() (allOutputFiles map[*Repository][]string, ok bool) {
+	s.UI.SetCurrentTask("Post-processing and signing packages", s.packageCount())
+	defer s.UI.EndTask()
+
+	allOutputFiles = make(map[*Repository][]string, len(s.Config.Targets))
+	ok = true
+	for _, src := range s.Config.Sources {
 		for _, pkg := range src.Packages {
-			files, err := cache.AddMissingSignatures(pkg, cfg.Target.Path, mcfg)
+			var files []string
+			var err error
+			switch {
+			case !s.isSelected(pkg) || s.isPinned(pkg):
+				var entry PackageCacheEntry
+				entry, err = s.Cache.GetEntryForPackage(pkg)
+				files = entry.OutputFiles
+			case s.DryRun != nil:
+				files, err = s.DryRun.planSignatures(s.Cache, pkg, src.Target.Path, s.Signer, s.Resign)
+			default:
+				files, err = s.Cache.AddMissingSignatures(pkg, src.Target.Path, s.Signer, s.Resign, s.UI)
+			}
 			if err != nil {
-				ui.ShowError(err)
-				exitCode = 1
+				s.UI.ShowError(err)
+				ok = false
 			}
-			allOutputFiles = append(allOutputFiles, files...)
-			ui.StepTask()
+			allOutputFiles[src.Target] = append(allOutputFiles[src.Target], files...)
+			s.UI.StepTask()
 		}
 	}
-	ui.EndTask()
-	if exitCode > 0 {
-		return
+	s.applyPins(allOutputFiles)
+	s.addLinkedOutputFiles(allOutputFiles)
+	return
+}
+
+// verifySignatures verifies the signatures of all output files and of the
+// repository metadata, ignoring previous verification results in the cache.
+// Invalid signatures are replaced if s.Resign is set.
+func (s *Session) verifySignatures(allOutputFiles map[*Repository][]string) (ok bool) {
+	if s.Signer == nil {
+		s.UI.ShowError(errors.New("cannot verify signatures: " + errSigningNotConfigured.Error()))
+		return false
 	}
 
-	ok := cfg.Target.addNewPackages(allOutputFiles, cache, ui)
-	if !ok {
-		exitCode = 1
-		return
+	var validCount, invalidCount, unsignedCount int
+	ok = true
+	for _, target := range s.Config.Targets {
+		s.UI.SetCurrentTask("Verifying signatures in "+target.DisplayName(), uint(len(allOutputFiles[target])))
+		for _, fileName := range allOutputFiles[target] {
+			s.UI.StepTask()
+			path := filepath.Join(target.Path, fileName)
+			exists, err := fileExists(path)
+			if err == nil && exists {
+				exists, err = fileExists(path + ".sig")
+				if err == nil && !exists {
+					s.UI.ShowWarning("%s is not signed", path)
+					unsignedCount++
+					continue
+				}
+			}
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+				continue
+			}
+			if !exists {
+				continue //not built yet
+			}
+
+			err = s.Cache.VerifySignature(path, s.Signer, true)
+			if err == nil {
+				validCount++
+				continue
+			}
+			invalidCount++
+			if !s.Resign {
+				s.UI.ShowError(err)
+				ok = false
+				continue
+			}
+			s.UI.ShowWarning("%s; signing again", err.Error())
+			err = resignFile(s.Signer, path)
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+			}
+		}
+		if !target.verifyDatabaseSignatures(s.Signer, s.Resign, s.UI) {
+			ok = false
+		}
+		s.UI.EndTask()
 	}
-	err = cache.writeCache() //since the previous call might have changed it
-	if err != nil {
-		ui.ShowError(err)
-		exitCode = 1
+
+	fmt.Printf("%d valid, %d invalid, %d missing signatures\n", validCount, invalidCount, unsignedCount)
+	return s.writeCache() && ok
+}
+
+// collectOutputFiles returns the list of all output files for each target
+// without touching the target directories.
+func (s *Session) collectOutputFiles() (allOutputFiles map[*Repository][]string, ok bool) {
+	allOutputFiles = make(map[*Repository][]string, len(s.Config.Targets))
+	ok = true
+	for _, src := range s.Config.Sources {
+		for _, pkg := range src.Packages {
+			entry, err := s.Cache.GetEntryForPackage(pkg)
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+			}
+			allOutputFiles[src.Target] = append(allOutputFiles[src.Target], entry.OutputFiles...)
+		}
 	}
-	ok = cfg.Target.pruneMetadata(allOutputFiles, ui)
-	if !ok {
-		exitCode = 1
-		return
+	s.applyPins(allOutputFiles)
+	s.addLinkedOutputFiles(allOutputFiles)
+	return
+}
+
+// addLinkedOutputFiles adds the output files for architecture "any" of the
+// first architecture of a multi-architecture target to the output files of
+// the other architectures (unless they were rolled back there).
+func (s *Session) addLinkedOutputFiles(allOutputFiles map[*Repository][]string) {
+	for _, target := range s.Config.Targets {
+		if target.AnyPackagesFrom == nil {
+			continue
+		}
+		for _, fileName := range allOutputFiles[target.AnyPackagesFrom] {
+			if isAnyPackageFile(fileName) {
+				allOutputFiles[target] = append(allOutputFiles[target], s.pinnedFileName(target, fileName))
+			}
+		}
 	}
-	ok = cfg.Target.prunePackages(allOutputFiles, ui)
-	if !ok {
-		exitCode = 1
-		return
+}
+
+func (s *Session) publishPackages(allOutputFiles map[*Repository][]string) bool {
+	ok := true
+	for _, target := range s.Config.Targets {
+		outputFiles := s.selectedOutputFiles(allOutputFiles[target])
+		if s.DryRun != nil {
+			err := s.DryRun.planPublish(target, outputFiles, s.Cache, s.UI)
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+			}
+			continue
+		}
+		targetOK := s.publishTarget(target, outputFiles, allOutputFiles)
+		s.Report.addOperation(target, "publish", targetOK)
+		if !targetOK {
+			ok = false
+		}
 	}
+	//write the cache even on error since the previous calls might have changed it
+	return s.writeCache() && ok
+}
 
-	return
+func (s *Session) publishTarget(target *Repository, outputFiles []string, allOutputFiles map[*Repository][]string) bool {
+	if target.AnyPackagesFrom != nil {
+		if !target.linkAnyPackages(s.selectedOutputFiles(allOutputFiles[target.AnyPackagesFrom]), s.UI) {
+			return false
+		}
+	}
+	return target.addNewPackages(outputFiles, s.Cache, s.UI) &&
+		target.checkFilesDatabase(s.UI) &&
+		target.signDatabases(s.Signer, s.UI)
+}
+
+func (s *Session) prune(allOutputFiles map[*Repository][]string) bool {
+	ok := true
+	for _, target := range s.Config.Targets {
+		filesToKeep, err := s.filesToKeep(target, allOutputFiles[target])
+		if err != nil {
+			s.UI.ShowError(err)
+			s.Report.addOperation(target, "prune", false)
+			ok = false
+			continue
+		}
+		if s.DryRun != nil {
+			err := s.DryRun.planPrune(target, filesToKeep)
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+			}
+			continue
+		}
+		targetOK := s.pruneTarget(target, filesToKeep)
+		s.Report.addOperation(target, "prune", targetOK)
+		if !targetOK {
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (s *Session) pruneTarget(target *Repository, filesToKeep []string) (ok bool) {
+	if !target.pruneMetadata(filesToKeep, s.UI) {
+		return false
+	}
+	ok = target.signDatabases(s.Signer, s.UI)
+	if !target.prunePackages(filesToKeep, s.UI) {
+		ok = false
+	}
+	return ok
 }
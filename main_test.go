@@ -0,0 +1,106 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBuildPackagesPropagatesFailures(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	//buildPackages() writes the cache file into the working directory
+	oldWorkDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(oldWorkDir)
+
+	target := &Repository{Name: "test", Path: filepath.Join(dirPath, "repo")}
+	err = os.Mkdir(target.Path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages := []Package{
+		&testPackage{Name: "lib", Fail: true},
+		&testPackage{Name: "app", Depends: []string{"lib"}},
+		&testPackage{Name: "app-plugin", Depends: []string{"app"}},
+		//"tool" is not selected, but the failure of "lib" is passed through it
+		&testPackage{Name: "tool", Depends: []string{"lib"}},
+		&testPackage{Name: "tool-plugin", Depends: []string{"tool"}},
+		&testPackage{Name: "other"},
+	}
+	s := &Session{
+		UI: &UI{},
+		Config: &Configuration{
+			Sources: []*Source{{Target: target, Packages: packages}},
+			Targets: []*Repository{target},
+			Jobs:    2,
+			Logs:    LogConfig{Path: filepath.Join(dirPath, "logs")},
+		},
+		Cache:  newTestCache(),
+		Report: newReport(),
+		Selection: &Selection{
+			CacheKeys: map[string]bool{"lib": true, "app": true, "app-plugin": true, "tool-plugin": true, "other": true},
+		},
+	}
+
+	if s.buildPackages() {
+		t.Error("expected buildPackages to fail")
+	}
+
+	var results []string
+	for _, result := range s.Report.Packages {
+		results = append(results, result.Package+": "+string(result.State)+": "+result.Error)
+	}
+	sort.Strings(results)
+	expected := []string{
+		"app-plugin: failed: not building app-plugin: dependency app could not be built",
+		"app: failed: not building app: dependency lib could not be built",
+		"lib: failed: build failed",
+		"other: built: ",
+		"tool-plugin: failed: not building tool-plugin: dependency lib could not be built",
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected results:\n\t%#v\ngot:\n\t%#v", expected, results)
+	}
+
+	//only the independent package was built
+	for _, pkg := range packages {
+		exists, err := fileExists(filepath.Join(target.Path, pkg.CacheKey()+"-1.0-1-any.pkg.tar.zst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shouldExist := pkg.CacheKey() == "other"; exists != shouldExist {
+			t.Errorf("expected output file of %s to exist = %t, got %t", pkg.CacheKey(), shouldExist, exists)
+		}
+	}
+}
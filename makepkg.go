@@ -19,44 +19,110 @@
 package main
 
 import (
-	"io/ioutil"
-	"os"
-	"regexp"
+	"bytes"
+	"fmt"
+	"os/exec"
 	"strings"
 )
 
 // MakepkgConfig contains the fields from makepkg.conf that interest us.
 type MakepkgConfig struct {
-	Architecture string
-	GPGKeyID     string
+	Architecture string //CARCH
+	GPGKeyID     string //GPGKEY
+	//PackageExtension is the file name extension of package files, e.g.
+	//".pkg.tar.zst" (PKGEXT).
+	PackageExtension string
 }
 
-var makepkgFieldRegex = regexp.MustCompile(`^([A-Z]+)\s*=\s*["']?(.*?)["']?$`)
+// This script loads the makepkg configuration in the same way as makepkg
+// itself does (see load_makepkg_config() in libmakepkg/util/config.sh), and
+// prints the variables that interest us as NUL-separated "KEY=VALUE" pairs.
+const makepkgConfigScript = `
+MAKEPKG_CONF="${1:-${MAKEPKG_CONF:-/etc/makepkg.conf}}"
+scalars=(CARCH GPGKEY PKGEXT)
 
-func readMakepkgConfig() (MakepkgConfig, error) {
-	bytes, err := ioutil.ReadFile("/etc/makepkg.conf")
+# variables from the environment take precedence over the config files
+for var in "${scalars[@]}"; do
+	declare "_env_$var=${!var}"
+done
+
+if [[ ! -r "$MAKEPKG_CONF" ]]; then
+	echo "cannot read $MAKEPKG_CONF" >&2
+	exit 1
+fi
+source "$MAKEPKG_CONF" || exit 1
+if [[ -d "$MAKEPKG_CONF.d" ]]; then
+	for conf in "$MAKEPKG_CONF.d"/*.conf; do
+		[[ -f "$conf" ]] && { source "$conf" || exit 1; }
+	done
+fi
+# the user's config does not apply inside a chroot (i.e. when an explicit
+# config file is given)
+user_conf="${XDG_CONFIG_HOME:-$HOME/.config}/pacman/makepkg.conf"
+if [[ -n "$1" ]]; then
+	:
+elif [[ -r "$user_conf" ]]; then
+	source "$user_conf" || exit 1
+elif [[ -r "$HOME/.makepkg.conf" ]]; then
+	source "$HOME/.makepkg.conf" || exit 1
+fi
+
+for var in "${scalars[@]}"; do
+	env_var="_env_$var"
+	printf '%s=%s\0' "$var" "${!env_var:-${!var}}"
+done
+`
+
+// readMakepkgConfig evaluates the makepkg configuration in the same way as
+// makepkg(8) does: by sourcing makepkg.conf (from $MAKEPKG_CONF, or from
+// /etc/makepkg.conf), the files in makepkg.conf.d, and the user's
+// makepkg.conf; and by giving precedence to the environment.
+//
+// If a path is given, it is the makepkg.conf of a chroot. Like
+// makechrootpkg(1), this uses only the given file and its makepkg.conf.d, not
+// the user's makepkg.conf.
+func readMakepkgConfig(path string) (MakepkgConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("bash", "-c", makepkgConfigScript, "bash", path)
+	cmd.Stdin = nil
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
-		return MakepkgConfig{}, err
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return MakepkgConfig{}, fmt.Errorf("cannot read makepkg config: %s", msg)
 	}
 
 	var result MakepkgConfig
-	result.GPGKeyID = os.Getenv("GPGKEY")
-	for _, line := range strings.Split(string(bytes), "\n") {
-		line = strings.TrimSpace(line)
-		match := makepkgFieldRegex.FindStringSubmatch(line)
-		if match != nil {
-			switch match[1] {
-			case "CARCH":
-				result.Architecture = match[2]
-			case "GPGKEY":
-				result.GPGKeyID = match[2]
-			}
+	for _, field := range strings.Split(stdout.String(), "\x00") {
+		fields := strings.SplitN(field, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		switch value := fields[1]; fields[0] {
+		case "CARCH":
+			result.Architecture = value
+		case "GPGKEY":
+			result.GPGKeyID = value
+		case "PKGEXT":
+			result.PackageExtension = value
 		}
 	}
-
+	if result.Architecture == "" {
+		return MakepkgConfig{}, fmt.Errorf("cannot read makepkg config: CARCH is not set")
+	}
 	return result, nil
 }
 
+// OutputSettings returns a string describing the settings that influence the
+// names of the output files, i.e. the architecture and the compression format.
+func (cfg MakepkgConfig) OutputSettings() string {
+	return "CARCH=" + cfg.Architecture + " PKGEXT=" + cfg.PackageExtension
+}
+
 // FilterFilesForCurrentArch takes a list of output files that can be generated
 // by a PKGBUILD, and returns only these matching the current architecture (i.e.
 // where the architecture is the current one or "any").
@@ -65,9 +131,11 @@ func (cfg MakepkgConfig) FilterFilesForCurrentArch(outputFiles []string) (result
 	arch2 := "-any"
 
 	for _, outputFile := range outputFiles {
-		str := strings.TrimSuffix(outputFile, ".pkg.tar.xz")
-		if strings.HasSuffix(outputFile, ".zst") {
-			str = strings.TrimSuffix(outputFile, ".pkg.tar.zst")
+		//strip the extension (usually ".pkg.tar.zst" or ".pkg.tar.xz", but PKGEXT
+		//could be set to a different compression format)
+		str := outputFile
+		if idx := strings.LastIndex(str, ".pkg.tar"); idx >= 0 {
+			str = str[:idx]
 		}
 		if strings.HasSuffix(str, arch1) || strings.HasSuffix(str, arch2) {
 			result = append(result, outputFile)
@@ -75,3 +143,30 @@ func (cfg MakepkgConfig) FilterFilesForCurrentArch(outputFiles []string) (result
 	}
 	return
 }
+
+// isAnyPackageFile returns whether the given package file name is for
+// architecture "any".
+func isAnyPackageFile(fileName string) bool {
+	return strings.Contains(fileName, "-any.pkg.tar")
+}
+
+// packageFileCompressions contains the file name suffixes that can follow
+// ".pkg.tar" in the name of a package file (i.e. all compression formats
+// supported by makepkg and pacman, and the empty string for no compression).
+var packageFileCompressions = []string{"", ".zst", ".xz", ".gz", ".bz2", ".lz4", ".lrz", ".lzo", ".Z", ".lz"}
+
+// isPackageFile returns whether the given file name is the name of a package
+// file (with any of the supported compression formats).
+func isPackageFile(fileName string) bool {
+	idx := strings.LastIndex(fileName, ".pkg.tar")
+	if idx <= 0 {
+		return false
+	}
+	suffix := fileName[idx+len(".pkg.tar"):]
+	for _, compression := range packageFileCompressions {
+		if suffix == compression {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMakepkgConfigForChroot(t *testing.T) {
+	dirPath := t.TempDir()
+	write := func(path, contents string) {
+		t.Helper()
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	confPath := filepath.Join(dirPath, "chroot", "makepkg.conf")
+	write(confPath, "CARCH=aarch64\nPKGEXT='.pkg.tar.xz'\nGPGKEY=\n")
+	write(confPath+".d/compression.conf", "PKGEXT='.pkg.tar.zst'\n")
+	write(confPath+".d/ignored.txt", "PKGEXT='.pkg.tar.gz'\n")
+
+	//the user's makepkg.conf is not used inside the chroot
+	home := filepath.Join(dirPath, "home")
+	write(filepath.Join(home, ".config", "pacman", "makepkg.conf"), "CARCH=x86_64\nPKGEXT='.pkg.tar.lz4'\n")
+	write(filepath.Join(home, ".makepkg.conf"), "CARCH=x86_64\nPKGEXT='.pkg.tar.lz4'\n")
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("MAKEPKG_CONF", filepath.Join(dirPath, "does-not-exist.conf"))
+	//(empty variables are treated like unset ones)
+	for _, name := range []string{"CARCH", "PKGEXT", "GPGKEY"} {
+		t.Setenv(name, "")
+	}
+
+	cfg, err := readMakepkgConfig(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MakepkgConfig{Architecture: "aarch64", PackageExtension: ".pkg.tar.zst"}
+	if cfg != expected {
+		t.Errorf("expected %#v, got %#v", expected, cfg)
+	}
+
+	//variables from the environment still take precedence
+	t.Setenv("PKGEXT", ".pkg.tar")
+	cfg, err = readMakepkgConfig(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.PackageExtension = ".pkg.tar"
+	if cfg != expected {
+		t.Errorf("expected %#v, got %#v", expected, cfg)
+	}
+}
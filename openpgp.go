@@ -0,0 +1,696 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+//This file contains a minimal implementation of OpenPGP (RFC 4880) that
+//supports just enough to create and verify detached signatures with an
+//unencrypted RSA or Ed25519 key from a key file, without needing gpg.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256" //register hash functions for crypto.Hash.New()
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	pgpTagSignature       = 2
+	pgpTagSecretKey       = 5
+	pgpTagPublicKey       = 6
+	pgpTagSecretSubkey    = 7
+	pgpTagPublicSubkey    = 14
+	pgpAlgoRSA            = 1
+	pgpAlgoRSASignOnly    = 3
+	pgpAlgoEdDSA          = 22
+	pgpSubpacketCreated   = 2
+	pgpSubpacketIssuer    = 16
+	pgpSubpacketKeyFlags  = 27
+	pgpSubpacketEmbedded  = 32
+	pgpSubpacketIssuerFpr = 33
+	pgpKeyFlagSign        = 0x02
+	pgpHashSHA1           = 2
+)
+
+// signature types from RFC 4880, section 5.2.1
+const (
+	pgpSigBinary            = 0x00
+	pgpSigSubkeyBinding     = 0x18
+	pgpSigPrimaryKeyBinding = 0x19
+)
+
+// OID of the Ed25519 curve (1.3.6.1.4.1.11591.15.1)
+var pgpOIDEd25519 = []byte{0x2B, 0x06, 0x01, 0x04, 0x01, 0xDA, 0x47, 0x0F, 0x01}
+
+// hash algorithm IDs from RFC 4880, section 9.4 (SHA-1 is deliberately not
+// included since it is not collision-resistant anymore)
+var pgpHashes = map[byte]crypto.Hash{
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// pgpKey is a key (or subkey) read from an OpenPGP key file.
+type pgpKey struct {
+	Algorithm   byte
+	Fingerprint []byte
+	//PrimaryFingerprint is only set for subkeys. It identifies the primary key
+	//that the subkey is bound to.
+	PrimaryFingerprint []byte
+	//PublicPart is the public key packet (or the public part of the secret key
+	//packet), which is covered by the subkey binding signatures.
+	PublicPart []byte
+	RSAPublic  *rsa.PublicKey
+	RSAPrivate *rsa.PrivateKey
+	EdPublic   ed25519.PublicKey
+	EdPrivate  ed25519.PrivateKey
+}
+
+// KeyID returns the 64-bit key ID, as a hex string.
+func (k pgpKey) KeyID() string {
+	return strings.ToUpper(hex.EncodeToString(k.Fingerprint[12:]))
+}
+
+// FingerprintString returns the fingerprint as a hex string.
+func (k pgpKey) FingerprintString() string {
+	return strings.ToUpper(hex.EncodeToString(k.Fingerprint))
+}
+
+// readPGPKeyFile reads all keys and subkeys with a supported algorithm from
+// the given file (in binary or ASCII-armored format). Subkeys are only
+// included if they are validly bound to their primary key as signing subkeys
+// (see pgpCheckSubkeyBinding). Unsupported keys (e.g. encryption subkeys) are
+// skipped.
+func readPGPKeyFile(path string) ([]pgpKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = pgpDearmor(buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+	}
+
+	var (
+		keys    []pgpKey
+		primary *pgpKey //the current primary key (nil if unsupported)
+		subkey  *pgpKey //the current subkey, until its binding has been verified
+	)
+	for len(buf) > 0 {
+		var (
+			tag  byte
+			body []byte
+		)
+		tag, body, buf, err = pgpReadPacket(buf)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+		}
+		switch tag {
+		case pgpTagSecretKey, pgpTagPublicKey:
+			key, err := pgpParseKey(body, tag == pgpTagSecretKey)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+			}
+			primary, subkey = key, nil
+			if key != nil {
+				keys = append(keys, *key)
+			}
+		case pgpTagSecretSubkey, pgpTagPublicSubkey:
+			key, err := pgpParseKey(body, tag == pgpTagSecretSubkey)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+			}
+			subkey = nil
+			if key != nil && primary != nil {
+				key.PrimaryFingerprint = primary.Fingerprint
+				subkey = key
+			}
+		case pgpTagSignature:
+			if subkey != nil && pgpCheckSubkeyBinding(*primary, *subkey, body) == nil {
+				keys = append(keys, *subkey)
+				subkey = nil
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("cannot read %s: no supported RSA or Ed25519 keys found", path)
+	}
+	return keys, nil
+}
+
+// pgpDearmor removes ASCII armor, if any.
+func pgpDearmor(buf []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN PGP ")) {
+		return buf, nil
+	}
+	var (
+		data     strings.Builder
+		inHeader = true
+		started  = false
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP "):
+			started = true
+		case !started:
+			continue
+		case strings.HasPrefix(line, "-----END PGP "):
+			return base64.StdEncoding.DecodeString(data.String())
+		case inHeader:
+			//armor headers (like "Comment: ...") end with an empty line
+			if line == "" {
+				inHeader = false
+			}
+		case strings.HasPrefix(line, "="):
+			//CRC24 checksum (not checked since the data is signed anyway)
+			continue
+		default:
+			data.WriteString(line)
+		}
+	}
+	return nil, errors.New("unterminated ASCII armor")
+}
+
+// pgpReadPacket reads the first packet from the given buffer, and returns its
+// tag, its body and the remainder of the buffer.
+func pgpReadPacket(buf []byte) (tag byte, body, rest []byte, err error) {
+	if len(buf) < 2 || buf[0]&0x80 == 0 {
+		return 0, nil, nil, errors.New("malformed packet header")
+	}
+	var length, headerLength int
+	if buf[0]&0x40 != 0 {
+		//new format
+		tag = buf[0] & 0x3F
+		switch o1 := int(buf[1]); {
+		case o1 < 192:
+			length, headerLength = o1, 2
+		case o1 < 224 && len(buf) >= 3:
+			length, headerLength = ((o1-192)<<8)+int(buf[2])+192, 3
+		case o1 == 255 && len(buf) >= 6:
+			length, headerLength = int(binary.BigEndian.Uint32(buf[2:6])), 6
+		default:
+			return 0, nil, nil, errors.New("unsupported packet length")
+		}
+	} else {
+		//old format
+		tag = (buf[0] >> 2) & 0x0F
+		switch buf[0] & 0x03 {
+		case 0:
+			length, headerLength = int(buf[1]), 2
+		case 1:
+			if len(buf) < 3 {
+				return 0, nil, nil, errors.New("malformed packet header")
+			}
+			length, headerLength = int(binary.BigEndian.Uint16(buf[1:3])), 3
+		case 2:
+			if len(buf) < 5 {
+				return 0, nil, nil, errors.New("malformed packet header")
+			}
+			length, headerLength = int(binary.BigEndian.Uint32(buf[1:5])), 5
+		default:
+			length, headerLength = len(buf)-1, 1
+		}
+	}
+	if length < 0 || headerLength+length > len(buf) {
+		return 0, nil, nil, errors.New("truncated packet")
+	}
+	return tag, buf[headerLength : headerLength+length], buf[headerLength+length:], nil
+}
+
+// pgpReadMPI reads a multiprecision integer from the given buffer.
+func pgpReadMPI(buf []byte) (value, rest []byte, err error) {
+	if len(buf) < 2 {
+		return nil, nil, errors.New("truncated MPI")
+	}
+	byteCount := (int(binary.BigEndian.Uint16(buf[0:2])) + 7) / 8
+	if len(buf) < 2+byteCount {
+		return nil, nil, errors.New("truncated MPI")
+	}
+	return buf[2 : 2+byteCount], buf[2+byteCount:], nil
+}
+
+// pgpWriteMPI appends the given big-endian integer as an MPI.
+func pgpWriteMPI(buf *bytes.Buffer, value []byte) {
+	value = bytes.TrimLeft(value, "\x00")
+	bitCount := 0
+	if len(value) > 0 {
+		bitCount = 8*(len(value)-1) + big.NewInt(int64(value[0])).BitLen()
+	}
+	binary.Write(buf, binary.BigEndian, uint16(bitCount))
+	buf.Write(value)
+}
+
+// leftPad pads the given big-endian integer with zeros to the given length.
+func leftPad(value []byte, length int) []byte {
+	if len(value) >= length {
+		return value
+	}
+	return append(make([]byte, length-len(value)), value...)
+}
+
+// pgpParseKey parses the body of a version 4 key packet. For unsupported
+// algorithms, nil is returned.
+func pgpParseKey(body []byte, isSecret bool) (*pgpKey, error) {
+	if len(body) < 6 {
+		return nil, errors.New("truncated key packet")
+	}
+	if body[0] != 4 {
+		return nil, fmt.Errorf("unsupported key packet version %d", body[0])
+	}
+	key := &pgpKey{Algorithm: body[5]}
+	rest := body[6:]
+
+	//parse public key material
+	var err error
+	switch key.Algorithm {
+	case pgpAlgoRSA, pgpAlgoRSASignOnly:
+		var n, e []byte
+		n, rest, err = pgpReadMPI(rest)
+		if err == nil {
+			e, rest, err = pgpReadMPI(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		key.RSAPublic = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case pgpAlgoEdDSA:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errors.New("truncated key packet")
+		}
+		oid := rest[1 : 1+int(rest[0])]
+		rest = rest[1+int(rest[0]):]
+		if !bytes.Equal(oid, pgpOIDEd25519) {
+			return nil, nil
+		}
+		var q []byte
+		q, rest, err = pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		//the public point is prefixed with 0x40 (native point format)
+		if len(q) != 1+ed25519.PublicKeySize || q[0] != 0x40 {
+			return nil, errors.New("malformed Ed25519 public key")
+		}
+		key.EdPublic = ed25519.PublicKey(q[1:])
+	default:
+		return nil, nil
+	}
+
+	//compute fingerprint (RFC 4880, section 12.2)
+	key.PublicPart = body[:len(body)-len(rest)]
+	h := sha1.New()
+	h.Write(pgpKeyHashPrefix(*key))
+	key.Fingerprint = h.Sum(nil)
+
+	if !isSecret {
+		return key, nil
+	}
+
+	//parse secret key material
+	if len(rest) < 1 {
+		return nil, errors.New("truncated secret key packet")
+	}
+	if rest[0] != 0 {
+		return nil, fmt.Errorf("secret key %s is protected with a passphrase, which is not supported", key.KeyID())
+	}
+	secret := rest[1:]
+	var mpis [][]byte
+	rest = secret
+	for len(mpis) < pgpSecretMPICount(key.Algorithm) {
+		var mpi []byte
+		mpi, rest, err = pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		mpis = append(mpis, mpi)
+	}
+
+	//the secret key material is followed by a checksum (RFC 4880, section 5.5.3)
+	if len(rest) < 2 {
+		return nil, errors.New("truncated secret key packet")
+	}
+	var checksum uint16
+	for _, b := range secret[:len(secret)-len(rest)] {
+		checksum += uint16(b)
+	}
+	if binary.BigEndian.Uint16(rest[0:2]) != checksum {
+		return nil, fmt.Errorf("invalid checksum for secret key %s", key.KeyID())
+	}
+
+	switch key.Algorithm {
+	case pgpAlgoRSA, pgpAlgoRSASignOnly:
+		//mpis[3] is u = p^-1 mod q, which is recomputed by Precompute()
+		key.RSAPrivate = &rsa.PrivateKey{
+			PublicKey: *key.RSAPublic,
+			D:         new(big.Int).SetBytes(mpis[0]),
+			Primes:    []*big.Int{new(big.Int).SetBytes(mpis[1]), new(big.Int).SetBytes(mpis[2])},
+		}
+		err = key.RSAPrivate.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA key %s: %s", key.KeyID(), err.Error())
+		}
+		key.RSAPrivate.Precompute()
+	case pgpAlgoEdDSA:
+		if len(mpis[0]) > ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid Ed25519 key %s: secret key is too long", key.KeyID())
+		}
+		key.EdPrivate = ed25519.NewKeyFromSeed(leftPad(mpis[0], ed25519.SeedSize))
+		if !bytes.Equal(key.EdPrivate.Public().(ed25519.PublicKey), key.EdPublic) {
+			return nil, fmt.Errorf("invalid Ed25519 key %s: secret key does not match public key", key.KeyID())
+		}
+	}
+	return key, nil
+}
+
+// pgpSecretMPICount returns the number of MPIs in the secret key material for
+// the given algorithm (d, p, q, u for RSA; the seed for Ed25519).
+func pgpSecretMPICount(algorithm byte) int {
+	if algorithm == pgpAlgoEdDSA {
+		return 1
+	}
+	return 4
+}
+
+// pgpSign creates a detached binary signature for the given data.
+func pgpSign(key pgpKey, data io.Reader) ([]byte, error) {
+	if key.RSAPrivate == nil && key.EdPrivate == nil {
+		return nil, fmt.Errorf("no secret key for %s", key.KeyID())
+	}
+
+	//hashed subpackets: creation time, issuer fingerprint
+	var hashed bytes.Buffer
+	hashed.Write([]byte{5, pgpSubpacketCreated})
+	binary.Write(&hashed, binary.BigEndian, uint32(time.Now().Unix()))
+	hashed.Write([]byte{22, pgpSubpacketIssuerFpr, 4})
+	hashed.Write(key.Fingerprint)
+
+	var header bytes.Buffer
+	header.Write([]byte{4, 0x00, key.Algorithm, 8}) //version 4, binary document, SHA-256
+	binary.Write(&header, binary.BigEndian, uint16(hashed.Len()))
+	header.Write(hashed.Bytes())
+
+	digest, err := pgpSignatureDigest(crypto.SHA256, data, header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.Write(header.Bytes())
+	//unhashed subpackets: issuer key ID
+	body.Write([]byte{0, 10, 9, pgpSubpacketIssuer})
+	body.Write(key.Fingerprint[12:])
+	body.Write(digest[:2])
+	if key.RSAPrivate != nil {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key.RSAPrivate, crypto.SHA256, digest)
+		if err != nil {
+			return nil, err
+		}
+		pgpWriteMPI(&body, sig)
+	} else {
+		sig := ed25519.Sign(key.EdPrivate, digest)
+		pgpWriteMPI(&body, sig[:32])
+		pgpWriteMPI(&body, sig[32:])
+	}
+
+	//new-format packet header with five-octet length
+	var packet bytes.Buffer
+	packet.Write([]byte{0xC0 | pgpTagSignature, 0xFF})
+	binary.Write(&packet, binary.BigEndian, uint32(body.Len()))
+	packet.Write(body.Bytes())
+	return packet.Bytes(), nil
+}
+
+// pgpSignatureDigest computes the digest that a version 4 signature is made
+// over (RFC 4880, section 5.2.4).
+func pgpSignatureDigest(hash crypto.Hash, data io.Reader, header []byte) ([]byte, error) {
+	h := hash.New()
+	_, err := io.Copy(h, data)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(header)
+	h.Write([]byte{4, 0xFF})
+	binary.Write(h, binary.BigEndian, uint32(len(header)))
+	return h.Sum(nil), nil
+}
+
+// pgpKeyHashPrefix returns the representation of the given key that is hashed
+// for fingerprints and key binding signatures (RFC 4880, section 5.2.4).
+func pgpKeyHashPrefix(key pgpKey) []byte {
+	return append([]byte{0x99, byte(len(key.PublicPart) >> 8), byte(len(key.PublicPart))}, key.PublicPart...)
+}
+
+// pgpSignature is a parsed version 4 signature packet.
+type pgpSignature struct {
+	Type               byte
+	PublicKeyAlgorithm byte
+	HashAlgorithm      byte
+	//Header is the part of the packet that is covered by the signature.
+	Header             []byte
+	HashedSubpackets   []byte
+	UnhashedSubpackets []byte
+	//Material contains the algorithm-specific MPIs.
+	Material []byte
+}
+
+// pgpParseSignature parses the body of a signature packet.
+func pgpParseSignature(body []byte) (*pgpSignature, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, errors.New("unsupported signature format")
+	}
+	sig := &pgpSignature{
+		Type:               body[1],
+		PublicKeyAlgorithm: body[2],
+		HashAlgorithm:      body[3],
+	}
+	hashedLength := int(binary.BigEndian.Uint16(body[4:6]))
+	if len(body) < 6+hashedLength+2 {
+		return nil, errors.New("truncated signature")
+	}
+	sig.Header = body[:6+hashedLength]
+	sig.HashedSubpackets = body[6 : 6+hashedLength]
+	rest := body[6+hashedLength:]
+	unhashedLength := int(binary.BigEndian.Uint16(rest[0:2]))
+	if len(rest) < 2+unhashedLength+2 {
+		return nil, errors.New("truncated signature")
+	}
+	sig.UnhashedSubpackets = rest[2 : 2+unhashedLength]
+	sig.Material = rest[2+unhashedLength+2:] //skip the left 16 bits of the hash
+	return sig, nil
+}
+
+// pgpVerify checks the given detached signature against the given data,
+// using whichever of the given keys issued the signature. Only signatures of
+// binary documents are accepted.
+func pgpVerify(keys []pgpKey, signature []byte, data io.Reader) error {
+	signature, err := pgpDearmor(signature)
+	if err != nil {
+		return err
+	}
+	tag, body, _, err := pgpReadPacket(signature)
+	if err != nil {
+		return err
+	}
+	if tag != pgpTagSignature {
+		return errors.New("not a signature")
+	}
+	sig, err := pgpParseSignature(body)
+	if err != nil {
+		return err
+	}
+	if sig.Type != pgpSigBinary {
+		return fmt.Errorf("unsupported signature type 0x%02X (expected a signature of a binary document)", sig.Type)
+	}
+
+	//find the key that issued this signature
+	issuer := pgpFindIssuer(sig.HashedSubpackets)
+	if issuer == "" {
+		issuer = pgpFindIssuer(sig.UnhashedSubpackets)
+	}
+	if issuer == "" {
+		return errors.New("signature does not name the key that made it")
+	}
+	var key *pgpKey
+	for idx := range keys {
+		if keys[idx].FingerprintString() == issuer || keys[idx].KeyID() == issuer {
+			key = &keys[idx]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("made with key %s instead of %s", issuer, keys[0].FingerprintString())
+	}
+	return pgpCheckSignature(*key, *sig, data)
+}
+
+// pgpCheckSubkeyBinding checks that the given signature packet body is a
+// valid binding signature for the given subkey, which marks the subkey as a
+// signing key, and that contains a valid back-signature made by the subkey
+// (RFC 4880, section 11.1).
+func pgpCheckSubkeyBinding(primary, subkey pgpKey, body []byte) error {
+	sig, err := pgpParseSignature(body)
+	if err != nil {
+		return err
+	}
+	if sig.Type != pgpSigSubkeyBinding {
+		return errors.New("not a subkey binding signature")
+	}
+	signedData := append(pgpKeyHashPrefix(primary), pgpKeyHashPrefix(subkey)...)
+	err = pgpCheckSignature(primary, *sig, bytes.NewReader(signedData))
+	if err != nil {
+		return err
+	}
+
+	flags, _ := pgpFindSubpacket(sig.HashedSubpackets, pgpSubpacketKeyFlags)
+	if len(flags) == 0 || flags[0]&pgpKeyFlagSign == 0 {
+		return errors.New("subkey is not a signing key")
+	}
+	embedded, found := pgpFindSubpacket(sig.HashedSubpackets, pgpSubpacketEmbedded)
+	if !found {
+		embedded, found = pgpFindSubpacket(sig.UnhashedSubpackets, pgpSubpacketEmbedded)
+	}
+	if !found {
+		return errors.New("missing primary key binding signature")
+	}
+	backSig, err := pgpParseSignature(embedded)
+	if err != nil {
+		return err
+	}
+	if backSig.Type != pgpSigPrimaryKeyBinding {
+		return errors.New("not a primary key binding signature")
+	}
+	return pgpCheckSignature(subkey, *backSig, bytes.NewReader(signedData))
+}
+
+// pgpCheckSignature checks that the given signature was made by the given key
+// over the given data.
+func pgpCheckSignature(key pgpKey, sig pgpSignature, data io.Reader) error {
+	if key.Algorithm != sig.PublicKeyAlgorithm {
+		return errors.New("signature algorithm does not match key")
+	}
+	if sig.HashAlgorithm == pgpHashSHA1 {
+		return errors.New("signatures using SHA-1 are not accepted")
+	}
+	hash, exists := pgpHashes[sig.HashAlgorithm]
+	if !exists {
+		return fmt.Errorf("unsupported hash algorithm %d", sig.HashAlgorithm)
+	}
+	digest, err := pgpSignatureDigest(hash, data, sig.Header)
+	if err != nil {
+		return err
+	}
+
+	switch key.Algorithm {
+	case pgpAlgoRSA, pgpAlgoRSASignOnly:
+		s, _, err := pgpReadMPI(sig.Material)
+		if err != nil {
+			return err
+		}
+		s = leftPad(s, key.RSAPublic.Size())
+		if rsa.VerifyPKCS1v15(key.RSAPublic, hash, digest, s) != nil {
+			return errors.New("signature does not match file contents")
+		}
+	case pgpAlgoEdDSA:
+		r, rest, err := pgpReadMPI(sig.Material)
+		if err != nil {
+			return err
+		}
+		s, _, err := pgpReadMPI(rest)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(key.EdPublic, digest, append(leftPad(r, 32), leftPad(s, 32)...)) {
+			return errors.New("signature does not match file contents")
+		}
+	default:
+		return fmt.Errorf("unsupported public key algorithm %d", key.Algorithm)
+	}
+	return nil
+}
+
+// pgpSplitSubpackets splits the given signature subpacket area into the
+// individual subpackets (RFC 4880, section 5.2.3.1), each starting with the
+// subpacket type. Malformed trailing data is ignored.
+func pgpSplitSubpackets(subpackets []byte) [][]byte {
+	var result [][]byte
+	for len(subpackets) > 0 {
+		var length, headerLength int
+		switch o1 := int(subpackets[0]); {
+		case o1 < 192:
+			length, headerLength = o1, 1
+		case o1 < 255 && len(subpackets) >= 2:
+			length, headerLength = ((o1-192)<<8)+int(subpackets[1])+192, 2
+		case o1 == 255 && len(subpackets) >= 5:
+			length, headerLength = int(binary.BigEndian.Uint32(subpackets[1:5])), 5
+		default:
+			return result
+		}
+		if length < 1 || len(subpackets) < headerLength+length {
+			return result
+		}
+		result = append(result, subpackets[headerLength:headerLength+length])
+		subpackets = subpackets[headerLength+length:]
+	}
+	return result
+}
+
+// pgpFindSubpacket returns the contents (after the type) of the first
+// subpacket with the given type.
+func pgpFindSubpacket(subpackets []byte, subpacketType byte) ([]byte, bool) {
+	for _, subpacket := range pgpSplitSubpackets(subpackets) {
+		//the high bit is the "critical" flag
+		if subpacket[0]&0x7F == subpacketType {
+			return subpacket[1:], true
+		}
+	}
+	return nil, false
+}
+
+// pgpFindIssuer returns the issuer fingerprint or key ID (as a hex string)
+// from the given signature subpackets.
+func pgpFindIssuer(subpackets []byte) string {
+	//the fingerprint is preceded by the key version
+	if fpr, found := pgpFindSubpacket(subpackets, pgpSubpacketIssuerFpr); found && len(fpr) >= 1 {
+		return strings.ToUpper(hex.EncodeToString(fpr[1:]))
+	}
+	if keyID, found := pgpFindSubpacket(subpackets, pgpSubpacketIssuer); found {
+		return strings.ToUpper(hex.EncodeToString(keyID))
+	}
+	return ""
+}
@@ -0,0 +1,508 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//The fixtures in testdata/openpgp were made with GnuPG 2.2:
+//
+//    gpg --quick-gen-key 'ART Test Ed25519 <ed25519@example.org>' ed25519 sign never
+//    gpg --quick-gen-key 'ART Test RSA <rsa@example.org>' rsa2048 sign never
+//    gpg --armor --export-secret-keys $ED25519_FPR > ed25519.asc
+//    gpg --export-secret-keys $RSA_FPR > rsa.gpg
+//    gpg -u $ED25519_FPR --armor --detach-sign -o message.txt.ed25519.asc message.txt
+//    gpg -u $RSA_FPR --detach-sign -o message.txt.rsa.sig message.txt
+//
+//    gpg --quick-gen-key 'ART Test Subkey <subkey@example.org>' ed25519 cert never
+//    gpg --quick-add-key $SUBKEY_PRIMARY_FPR ed25519 sign never
+//    gpg --quick-add-key $SUBKEY_PRIMARY_FPR cv25519 encr never
+//    gpg --armor --export-secret-keys $SUBKEY_PRIMARY_FPR > subkey.asc
+//    gpg -u $SUBKEY_FPR! --detach-sign -o message.txt.subkey.sig message.txt
+//    gpg -u $ED25519_FPR --textmode --detach-sign -o message.txt.text.sig message.txt
+//    gpg -u $RSA_FPR --digest-algo SHA1 --detach-sign -o message.txt.sha1.sig message.txt
+//
+//These keys are only used for testing.
+
+var testPGPKeys = []struct {
+	Name        string
+	KeyFile     string
+	Fingerprint string
+	Algorithm   byte
+	Signature   string
+}{
+	{"Ed25519", "ed25519.asc", "035E8730095AB41828B0A311F01D0B6CED107E37", pgpAlgoEdDSA, "message.txt.ed25519.asc"},
+	{"RSA", "rsa.gpg", "38B33E7F45000D162CE6AD0C0F06872585D7EB31", pgpAlgoRSA, "message.txt.rsa.sig"},
+}
+
+func testdataPath(name string) string {
+	return filepath.Join("testdata", "openpgp", name)
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func mustReadPGPKeyFile(t *testing.T, name string) []pgpKey {
+	t.Helper()
+	keys, err := readPGPKeyFile(testdataPath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestPGPReadKeyFile(t *testing.T) {
+	for _, tk := range testPGPKeys {
+		keys := mustReadPGPKeyFile(t, tk.KeyFile)
+		if len(keys) != 1 {
+			t.Fatalf("%s: expected 1 key, got %d", tk.Name, len(keys))
+		}
+		key := keys[0]
+		if key.FingerprintString() != tk.Fingerprint {
+			t.Errorf("%s: expected fingerprint %s, got %s", tk.Name, tk.Fingerprint, key.FingerprintString())
+		}
+		if key.KeyID() != tk.Fingerprint[24:] {
+			t.Errorf("%s: expected key ID %s, got %s", tk.Name, tk.Fingerprint[24:], key.KeyID())
+		}
+		if key.Algorithm != tk.Algorithm {
+			t.Errorf("%s: expected algorithm %d, got %d", tk.Name, tk.Algorithm, key.Algorithm)
+		}
+		if key.RSAPrivate == nil && key.EdPrivate == nil {
+			t.Errorf("%s: secret key material is missing", tk.Name)
+		}
+	}
+}
+
+func TestPGPSignVerifyRoundTrip(t *testing.T) {
+	for _, tk := range testPGPKeys {
+		dirPath := t.TempDir()
+		path := filepath.Join(dirPath, "data.bin")
+		err := ioutil.WriteFile(path, []byte("some package contents\x00\x01\x02"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signer, err := newKeyFileSigner(testdataPath(tk.KeyFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer.Identity() != tk.Fingerprint {
+			t.Errorf("%s: expected identity %s, got %s", tk.Name, tk.Fingerprint, signer.Identity())
+		}
+		err = signer.Sign(path)
+		if err != nil {
+			t.Fatalf("%s: sign: %s", tk.Name, err.Error())
+		}
+		err = signer.Verify(path)
+		if err != nil {
+			t.Errorf("%s: verify: %s", tk.Name, err.Error())
+		}
+
+		//the signature must also be verifiable by gpg
+		verifyWithGPG(t, tk.KeyFile, path+".sig", path)
+	}
+}
+
+// verifyWithGPG checks the given signature with gpg, if it is installed.
+func verifyWithGPG(t *testing.T, keyFile, sigPath, dataPath string) {
+	t.Helper()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Log("skipping verification with gpg: ", err.Error())
+		return
+	}
+	home := t.TempDir()
+	for _, args := range [][]string{
+		{"--import", testdataPath(keyFile)},
+		{"--trust-model", "always", "--verify", sigPath, dataPath},
+	} {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch"}, args...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("gpg %s failed: %s\n%s", strings.Join(args, " "), err.Error(), output)
+			return
+		}
+	}
+}
+
+func TestPGPVerifyGPGSignature(t *testing.T) {
+	data := mustReadFile(t, testdataPath("message.txt"))
+	for _, tk := range testPGPKeys {
+		keys := mustReadPGPKeyFile(t, tk.KeyFile)
+		sig := mustReadFile(t, testdataPath(tk.Signature))
+		err := pgpVerify(keys, sig, bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %s", tk.Name, err.Error())
+		}
+	}
+}
+
+func TestPGPVerifyRejectsTamperedData(t *testing.T) {
+	data := mustReadFile(t, testdataPath("message.txt"))
+	tampered := append([]byte(nil), data...)
+	tampered[0] ^= 0x01
+	for _, tk := range testPGPKeys {
+		keys := mustReadPGPKeyFile(t, tk.KeyFile)
+		sig := mustReadFile(t, testdataPath(tk.Signature))
+		for _, input := range [][]byte{tampered, append(data, '\n'), data[:len(data)-1]} {
+			err := pgpVerify(keys, sig, bytes.NewReader(input))
+			if err == nil || !strings.Contains(err.Error(), "does not match") {
+				t.Errorf("%s: expected mismatch error for %q, got %v", tk.Name, input, err)
+			}
+		}
+	}
+}
+
+func TestPGPVerifyRejectsWrongKey(t *testing.T) {
+	data := mustReadFile(t, testdataPath("message.txt"))
+	for idx, tk := range testPGPKeys {
+		other := testPGPKeys[1-idx]
+		keys := mustReadPGPKeyFile(t, other.KeyFile)
+		sig := mustReadFile(t, testdataPath(tk.Signature))
+		err := pgpVerify(keys, sig, bytes.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(), "made with key "+tk.Fingerprint) {
+			t.Errorf("%s signature checked with %s key: expected wrong-key error, got %v", tk.Name, other.Name, err)
+		}
+	}
+
+	//a signature with a forged issuer must not verify either
+	keys := mustReadPGPKeyFile(t, "rsa.gpg")
+	sig, err := pgpDearmor(mustReadFile(t, testdataPath("message.txt.ed25519.asc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := bytes.Replace(sig, mustDecodeHex(t, testPGPKeys[0].Fingerprint), mustDecodeHex(t, testPGPKeys[1].Fingerprint), -1)
+	err = pgpVerify(keys, forged, bytes.NewReader(data))
+	if err == nil {
+		t.Error("expected signature with forged issuer to be rejected")
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestPGPVerifyRejectsTruncatedSignature(t *testing.T) {
+	data := mustReadFile(t, testdataPath("message.txt"))
+	for _, tk := range testPGPKeys {
+		keys := mustReadPGPKeyFile(t, tk.KeyFile)
+		sig, err := pgpDearmor(mustReadFile(t, testdataPath(tk.Signature)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//truncated packet (packet header claims more data than available)
+		for length := 0; length < len(sig); length++ {
+			err := pgpVerify(keys, sig[:length], bytes.NewReader(data))
+			if err == nil {
+				t.Errorf("%s: expected error for signature truncated to %d bytes", tk.Name, length)
+			}
+		}
+
+		//truncated packet body (with a packet header that matches the
+		//truncated length)
+		_, body, _, err := pgpReadPacket(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for length := 0; length < len(body); length++ {
+			var packet bytes.Buffer
+			packet.Write([]byte{0xC0 | pgpTagSignature, 0xFF})
+			binary.Write(&packet, binary.BigEndian, uint32(length))
+			packet.Write(body[:length])
+			err := pgpVerify(keys, packet.Bytes(), bytes.NewReader(data))
+			if err == nil {
+				t.Errorf("%s: expected error for signature body truncated to %d bytes", tk.Name, length)
+			}
+		}
+	}
+}
+
+func TestPGPReadKeyFileRejectsTruncatedPackets(t *testing.T) {
+	for _, tk := range testPGPKeys {
+		buf, err := pgpDearmor(mustReadFile(t, testdataPath(tk.KeyFile)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, firstBody, _, err := pgpReadPacket(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(t.TempDir(), "key")
+		for length := 0; length < len(buf); length++ {
+			err := ioutil.WriteFile(path, buf[:length], 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = readPGPKeyFile(path)
+			//when only trailing packets (user ID, self-signature) are cut off,
+			//the key itself may still be readable
+			if err == nil && length < len(firstBody) {
+				t.Errorf("%s: expected error for key file truncated to %d bytes", tk.Name, length)
+			}
+		}
+
+		//truncated key packet body (with a matching packet header)
+		for length := 0; length < len(firstBody); length++ {
+			_, err := pgpParseKey(firstBody[:length], true)
+			if err == nil {
+				t.Errorf("%s: expected error for key packet truncated to %d bytes", tk.Name, length)
+			}
+		}
+	}
+}
+
+func TestPGPDearmor(t *testing.T) {
+	armored := mustReadFile(t, testdataPath("message.txt.ed25519.asc"))
+	sig, err := pgpDearmor(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, _, rest, err := pgpReadPacket(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != pgpTagSignature || len(rest) != 0 {
+		t.Errorf("expected a single signature packet, got tag %d with %d bytes of trailing data", tag, len(rest))
+	}
+
+	//binary input is passed through unchanged
+	binarySig := mustReadFile(t, testdataPath("message.txt.rsa.sig"))
+	buf, err := pgpDearmor(binarySig)
+	if err != nil || !bytes.Equal(buf, binarySig) {
+		t.Errorf("expected binary input to be returned unchanged, got error %v", err)
+	}
+
+	//unterminated armor is rejected
+	idx := bytes.Index(armored, []byte("-----END"))
+	_, err = pgpDearmor(armored[:idx])
+	if err == nil {
+		t.Error("expected error for unterminated armor")
+	}
+}
+
+const (
+	testSubkeyPrimaryFingerprint = "614D7B94CA2B8D2879399BF4F141F1B8B4B1B080"
+	testSubkeyFingerprint        = "570EBB19AC72CBC2ED92AFA1BDCDA2442E777C30"
+)
+
+func TestPGPReadKeyFileWithSubkeys(t *testing.T) {
+	//the encryption subkey is skipped
+	keys := mustReadPGPKeyFile(t, "subkey.asc")
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	if fpr := keys[0].FingerprintString(); fpr != testSubkeyPrimaryFingerprint || keys[0].PrimaryFingerprint != nil {
+		t.Errorf("expected primary key %s, got %s (bound to %X)", testSubkeyPrimaryFingerprint, fpr, keys[0].PrimaryFingerprint)
+	}
+	if fpr := keys[1].FingerprintString(); fpr != testSubkeyFingerprint {
+		t.Errorf("expected signing subkey %s, got %s", testSubkeyFingerprint, fpr)
+	}
+	if !bytes.Equal(keys[1].PrimaryFingerprint, keys[0].Fingerprint) {
+		t.Errorf("expected subkey to be bound to %s, got %X", testSubkeyPrimaryFingerprint, keys[1].PrimaryFingerprint)
+	}
+}
+
+// writeModifiedSubkeyFile writes a copy of subkey.asc where the signature
+// packet following the signing subkey has been modified by `modify`.
+func writeModifiedSubkeyFile(t *testing.T, modify func(sigBody []byte)) string {
+	t.Helper()
+	buf, err := pgpDearmor(mustReadFile(t, testdataPath("subkey.asc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//packet bodies returned by pgpReadPacket() point into `buf`
+	rest := buf
+	isAfterSubkey := false
+	for len(rest) > 0 {
+		var (
+			tag  byte
+			body []byte
+		)
+		tag, body, rest, err = pgpReadPacket(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag == pgpTagSignature && isAfterSubkey {
+			modify(body)
+			break
+		}
+		isAfterSubkey = tag == pgpTagSecretSubkey
+	}
+	path := filepath.Join(t.TempDir(), "subkey.gpg")
+	err = ioutil.WriteFile(path, buf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPGPReadKeyFileRejectsInvalidSubkeyBindings(t *testing.T) {
+	testCases := map[string]func(sigBody []byte){
+		//the binding signature itself ends with the signature MPIs
+		"binding signature": func(sigBody []byte) {
+			sigBody[len(sigBody)-1] ^= 0x01
+		},
+		//the back-signature by the subkey is embedded in the unhashed
+		//subpackets, and also ends with its MPIs
+		"back-signature": func(sigBody []byte) {
+			sig, err := pgpParseSignature(sigBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			embedded, found := pgpFindSubpacket(sig.UnhashedSubpackets, pgpSubpacketEmbedded)
+			if !found {
+				t.Fatal("no back-signature found in fixture")
+			}
+			embedded[len(embedded)-1] ^= 0x01
+		},
+		"signature type": func(sigBody []byte) {
+			sigBody[1] = 0x1F //direct-key signature
+		},
+	}
+	for name, modify := range testCases {
+		keys, err := readPGPKeyFile(writeModifiedSubkeyFile(t, modify))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].FingerprintString() != testSubkeyPrimaryFingerprint {
+			t.Errorf("with invalid %s: expected only the primary key to be read, got %d keys", name, len(keys))
+		}
+	}
+}
+
+func TestPGPVerifySubkeySignature(t *testing.T) {
+	dirPath := t.TempDir()
+	path := filepath.Join(dirPath, "message.txt")
+	err := ioutil.WriteFile(path, mustReadFile(t, testdataPath("message.txt")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path+".sig", mustReadFile(t, testdataPath("message.txt.subkey.sig")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := newKeyFileSigner(testdataPath("subkey.asc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Identity() != testSubkeyPrimaryFingerprint {
+		t.Errorf("expected identity %s, got %s", testSubkeyPrimaryFingerprint, signer.Identity())
+	}
+	err = signer.Verify(path)
+	if err != nil {
+		t.Error(err)
+	}
+
+	//without a valid binding, the subkey's signatures are not accepted
+	signer, err = newKeyFileSigner(writeModifiedSubkeyFile(t, func(sigBody []byte) {
+		sigBody[len(sigBody)-1] ^= 0x01
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signer.Verify(path)
+	if err == nil || !strings.Contains(err.Error(), "made with key "+testSubkeyFingerprint) {
+		t.Errorf("expected signature by unbound subkey to be rejected, got %v", err)
+	}
+}
+
+func TestKeyFileSignerOnlyAcceptsSigningKey(t *testing.T) {
+	//a key file with multiple keys: signatures by the first key (which is used
+	//for signing) are accepted, but not those by the other key
+	var buf []byte
+	for _, tk := range testPGPKeys {
+		key, err := pgpDearmor(mustReadFile(t, testdataPath(tk.KeyFile)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, key...)
+	}
+	dirPath := t.TempDir()
+	keyPath := filepath.Join(dirPath, "keys.gpg")
+	err := ioutil.WriteFile(keyPath, buf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newKeyFileSigner(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Identity() != testPGPKeys[0].Fingerprint {
+		t.Fatalf("expected identity %s, got %s", testPGPKeys[0].Fingerprint, signer.Identity())
+	}
+
+	path := filepath.Join(dirPath, "message.txt")
+	err = ioutil.WriteFile(path, mustReadFile(t, testdataPath("message.txt")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, tk := range testPGPKeys {
+		err = ioutil.WriteFile(path+".sig", mustReadFile(t, testdataPath(tk.Signature)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = signer.Verify(path)
+		if idx == 0 && err != nil {
+			t.Errorf("expected %s signature to be accepted, got %s", tk.Name, err.Error())
+		}
+		if idx != 0 && (err == nil || !strings.Contains(err.Error(), "made with key "+tk.Fingerprint)) {
+			t.Errorf("expected %s signature to be rejected, got %v", tk.Name, err)
+		}
+	}
+}
+
+func TestPGPVerifyRejectsWeakSignatures(t *testing.T) {
+	data := mustReadFile(t, testdataPath("message.txt"))
+	testCases := []struct {
+		KeyFile   string
+		Signature string
+		Error     string
+	}{
+		{"ed25519.asc", "message.txt.text.sig", "unsupported signature type 0x01"},
+		{"rsa.gpg", "message.txt.sha1.sig", "signatures using SHA-1 are not accepted"},
+	}
+	for _, c := range testCases {
+		keys := mustReadPGPKeyFile(t, c.KeyFile)
+		err := pgpVerify(keys, mustReadFile(t, testdataPath(c.Signature)), bytes.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(), c.Error) {
+			t.Errorf("%s: expected error %q, got %v", c.Signature, c.Error, err)
+		}
+	}
+}
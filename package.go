@@ -20,11 +20,17 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
-	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
 // Package is a package definition. It is satisfied by types HoloBuildPackage
@@ -32,12 +38,77 @@ import (
 type Package interface {
 	//CacheKey returns a string that uniquely idenfities this package.
 	CacheKey() string
-	//LastModified returns the mtime of the package definition file.
-	LastModified() (time.Time, error)
+	//DefinitionPath returns the path of the package definition file. When a
+	//package definition is built for multiple architectures, all instances
+	//have the same DefinitionPath, but different CacheKeys.
+	DefinitionPath() string
+	//InputFiles returns the paths of the package definition file and of all
+	//local files referenced by it (e.g. patches or install scripts).
+	InputFiles() ([]string, error)
 	//OutputFiles returns the list of files produced by Build().
 	OutputFiles() ([]string, error)
-	//Build builds all output files into the given target directory.
-	Build(targetDirPath string) error
+	//OutputSettings returns the settings from the makepkg configuration that
+	//influence the names of the output files (see MakepkgConfig.OutputSettings).
+	OutputSettings() string
+	//Relations returns the names of the packages produced by Build(), and
+	//their relations to other packages.
+	Relations() (PackageRelations, error)
+	//Build builds all output files.
+	Build(opts BuildOptions) error
+	//BumpRelease increments the release number (pkgrel) in the package
+	//definition, so that the next build produces output files with new names.
+	BumpRelease() error
+}
+
+// BuildOptions contains the parameters for Package.Build().
+type BuildOptions struct {
+	//DestDirPath is the directory where the output files shall be placed.
+	DestDirPath string
+	//DependencyFiles contains the paths of previously built package files that
+	//this package depends on. Builders that do not build on the host system
+	//need to install these before building.
+	DependencyFiles []string
+	//Output receives the output of the build tool (both stdout and stderr).
+	Output io.Writer
+}
+
+// PackageRelations describes which package names are provided by a Package,
+// and which package names it depends on.
+type PackageRelations struct {
+	//Names contains the names of all packages produced by Build().
+	Names []string
+	//Provides contains the "provides" entries of all packages produced by
+	//Build(), without version constraints.
+	Provides []string
+	//Depends contains the runtime and build-time dependencies of all packages
+	//produced by Build(), without version constraints.
+	Depends []string
+}
+
+// ArchVariant is embedded in the Package implementations. It identifies the
+// instance of a package definition when the same definition is built for
+// multiple architectures. For targets with only one architecture, it is zero.
+type ArchVariant struct {
+	Arch string
+	//SkipAnyPackages is set if output files for architecture "any" are built by
+	//the instance of the same package definition for a different architecture.
+	SkipAnyPackages bool
+}
+
+func (v ArchVariant) cacheKey(path string) string {
+	if v.Arch == "" {
+		return path
+	}
+	return path + "#" + v.Arch
+}
+
+func (v ArchVariant) filterOutputFiles(mcfg MakepkgConfig, fileNames []string) (result []string) {
+	for _, fileName := range mcfg.FilterFilesForCurrentArch(fileNames) {
+		if !(v.SkipAnyPackages && isAnyPackageFile(fileName)) {
+			result = append(result, fileName)
+		}
+	}
+	return
 }
 
 // HoloBuildPackage describes a package declaration that can be built by using
@@ -45,20 +116,38 @@ type Package interface {
 type HoloBuildPackage struct {
 	Path          string
 	MakepkgConfig MakepkgConfig
+	ArchVariant
 }
 
 // CacheKey implements the Package interface.
 func (pkg HoloBuildPackage) CacheKey() string {
+	return pkg.cacheKey(pkg.Path)
+}
+
+// DefinitionPath implements the Package interface.
+func (pkg HoloBuildPackage) DefinitionPath() string {
 	return pkg.Path
 }
 
-// LastModified implements the Package interface.
-func (pkg HoloBuildPackage) LastModified() (time.Time, error) {
-	fi, err := os.Stat(pkg.Path)
+// InputFiles implements the Package interface.
+func (pkg HoloBuildPackage) InputFiles() ([]string, error) {
+	var def struct {
+		Files []struct {
+			ContentFrom string `toml:"contentFrom"`
+		} `toml:"file"`
+	}
+	_, err := toml.DecodeFile(pkg.Path, &def)
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
-	return fi.ModTime(), nil
+
+	result := []string{pkg.Path}
+	for _, file := range def.Files {
+		if file.ContentFrom != "" {
+			result = append(result, resolveRelativeTo(pkg.Path, file.ContentFrom))
+		}
+	}
+	return result, nil
 }
 
 // OutputFiles implements the Package interface.
@@ -70,49 +159,104 @@ func (pkg HoloBuildPackage) OutputFiles() ([]string, error) {
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
 	result := []string{strings.TrimSpace(string(buf.Bytes()))}
-	return pkg.MakepkgConfig.FilterFilesForCurrentArch(result), err
+	return pkg.filterOutputFiles(pkg.MakepkgConfig, result), err
+}
+
+// OutputSettings implements the Package interface.
+func (pkg HoloBuildPackage) OutputSettings() string {
+	return pkg.MakepkgConfig.OutputSettings()
+}
+
+// Relations implements the Package interface.
+func (pkg HoloBuildPackage) Relations() (PackageRelations, error) {
+	var def struct {
+		Package struct {
+			Name     string   `toml:"name"`
+			Requires []string `toml:"requires"`
+			Provides []string `toml:"provides"`
+		} `toml:"package"`
+	}
+	_, err := toml.DecodeFile(pkg.Path, &def)
+	if err != nil {
+		return PackageRelations{}, err
+	}
+
+	var rel PackageRelations
+	rel.Names = []string{def.Package.Name}
+	for _, spec := range def.Package.Provides {
+		rel.Provides = append(rel.Provides, stripVersionConstraint(spec))
+	}
+	for _, spec := range def.Package.Requires {
+		rel.Depends = append(rel.Depends, stripVersionConstraint(spec))
+	}
+	return rel, nil
 }
 
 // Build implements the Package interface.
-func (pkg HoloBuildPackage) Build(targetDirPath string) error {
+func (pkg HoloBuildPackage) Build(opts BuildOptions) error {
 	absPath, err := filepath.Abs(pkg.Path)
 	if err != nil {
 		return err
 	}
 
 	cmd := exec.Command("holo-build", absPath)
-	cmd.Dir = targetDirPath
+	cmd.Dir = opts.DestDirPath
 	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = opts.Output
+	cmd.Stderr = opts.Output
 	return cmd.Run()
 }
 
+// BumpRelease implements the Package interface.
+func (pkg HoloBuildPackage) BumpRelease() error {
+	return bumpReleaseInFile(pkg.Path, holoBuildReleaseRx)
+}
+
 // NativePackage describes a directory with a PKGBUILD that can be built using
 // makepkg(8).
 type NativePackage struct {
 	Path          string
 	MakepkgConfig MakepkgConfig
+	//Chroot is nil if the package shall be built on the host system.
+	Chroot *ChrootBuilder
+	ArchVariant
 }
 
 // CacheKey implements the Package interface.
 func (pkg NativePackage) CacheKey() string {
+	return pkg.cacheKey(pkg.Path)
+}
+
+// DefinitionPath implements the Package interface.
+func (pkg NativePackage) DefinitionPath() string {
 	return pkg.Path
 }
 
-// LastModified implements the Package interface.
-func (pkg NativePackage) LastModified() (time.Time, error) {
-	fi, err := os.Stat(pkg.Path)
+// InputFiles implements the Package interface.
+func (pkg NativePackage) InputFiles() ([]string, error) {
+	info, err := pkg.SrcInfo()
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
-	return fi.ModTime(), nil
+
+	result := []string{pkg.Path}
+	for _, source := range info.Sources {
+		//sources with a URL (optionally with a "filename::" prefix) are
+		//downloaded by makepkg; only local files are of interest here
+		if strings.Contains(source, "::") || strings.Contains(source, "://") {
+			continue
+		}
+		result = append(result, resolveRelativeTo(pkg.Path, source))
+	}
+	for _, fileName := range append(info.Install, info.Changelog...) {
+		result = append(result, resolveRelativeTo(pkg.Path, fileName))
+	}
+	return result, nil
 }
 
 // OutputFiles implements the Package interface.
 func (pkg NativePackage) OutputFiles() ([]string, error) {
-	cmd := exec.Command("makepkg", "--packagelist", "-p", filepath.Base(pkg.Path))
-	cmd.Dir = filepath.Dir(pkg.Path)
+	cmd := pkg.makepkgQuery("--packagelist")
 	cmd.Stdin = nil
 	var buf bytes.Buffer
 	cmd.Stdout = &buf
@@ -130,18 +274,131 @@ func (pkg NativePackage) OutputFiles() ([]string, error) {
 		}
 		result = append(result, filepath.Base(line))
 	}
-	return pkg.MakepkgConfig.FilterFilesForCurrentArch(result), nil
+	return pkg.filterOutputFiles(pkg.MakepkgConfig, result), nil
+}
+
+// OutputSettings implements the Package interface.
+func (pkg NativePackage) OutputSettings() string {
+	return pkg.MakepkgConfig.OutputSettings()
+}
+
+// Relations implements the Package interface.
+func (pkg NativePackage) Relations() (PackageRelations, error) {
+	info, err := pkg.SrcInfo()
+	if err != nil {
+		return PackageRelations{}, err
+	}
+
+	var rel PackageRelations
+	rel.Names = info.PackageNames
+	for _, spec := range info.Provides {
+		rel.Provides = append(rel.Provides, stripVersionConstraint(spec))
+	}
+	for _, specs := range [][]string{info.Depends, info.MakeDepends, info.CheckDepends} {
+		for _, spec := range specs {
+			rel.Depends = append(rel.Depends, stripVersionConstraint(spec))
+		}
+	}
+	return rel, nil
+}
+
+// SrcInfo evaluates the PKGBUILD using `makepkg --printsrcinfo`.
+func (pkg NativePackage) SrcInfo() (SrcInfo, error) {
+	cmd := pkg.makepkgQuery("--printsrcinfo")
+	cmd.Stdin = nil
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return SrcInfo{}, err
+	}
+	return parseSrcInfo(buf.Bytes(), pkg.MakepkgConfig.Architecture)
+}
+
+// makepkgQuery prepares a makepkg invocation that reports information about
+// the package without building it. When building in a chroot with its own
+// makepkg.conf, that config is used to get the same results as inside the
+// chroot (esp. for a different architecture).
+func (pkg NativePackage) makepkgQuery(arg string) *exec.Cmd {
+	args := []string{arg, "-p", filepath.Base(pkg.Path)}
+	if pkg.Chroot != nil && pkg.Chroot.MakepkgConfigPath != "" {
+		args = append(args, "--config", pkg.Chroot.MakepkgConfigPath)
+	}
+	cmd := exec.Command("makepkg", args...)
+	cmd.Dir = filepath.Dir(pkg.Path)
+	return cmd
 }
 
 // Build implements the Package interface.
-func (pkg NativePackage) Build(targetDirPath string) error {
+func (pkg NativePackage) Build(opts BuildOptions) error {
+	if pkg.Chroot != nil {
+		return pkg.Chroot.Build(pkg, opts)
+	}
+
 	cmd := exec.Command("makepkg", "-s", "-p", filepath.Base(pkg.Path))
 	cmd.Dir = filepath.Dir(pkg.Path)
 	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = opts.Output
+	cmd.Stderr = opts.Output
 	cmd.Env = append(os.Environ(),
-		"PKGDEST="+targetDirPath,
+		"PKGDEST="+opts.DestDirPath,
 	)
 	return cmd.Run()
 }
+
+// BumpRelease implements the Package interface.
+func (pkg NativePackage) BumpRelease() error {
+	return bumpReleaseInFile(pkg.Path, pkgbuildReleaseRx)
+}
+
+var (
+	//the second submatch is the release number; for PKGBUILDs, this can also
+	//be a subrelease like "2.1"
+	pkgbuildReleaseRx  = regexp.MustCompile(`(?m)^(pkgrel=["']?)([0-9]+(?:\.[0-9]+)?)(["']?\s*)$`)
+	holoBuildReleaseRx = regexp.MustCompile(`(?m)^(\s*release\s*=\s*)([0-9]+)(\s*)$`)
+)
+
+// bumpReleaseInFile increments the release number in the first line of the
+// given package definition that matches the given regex (see above). For a
+// subrelease, the subrelease is incremented instead, e.g. "2.1" is bumped to
+// "2.2".
+func bumpReleaseInFile(path string, rx *regexp.Regexp) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	match := rx.FindSubmatchIndex(buf)
+	if match == nil {
+		return fmt.Errorf("cannot bump release number in %s: no release number found", path)
+	}
+	release := string(buf[match[4]:match[5]])
+	prefix := ""
+	if idx := strings.LastIndex(release, "."); idx >= 0 {
+		prefix, release = release[:idx+1], release[idx+1:]
+	}
+	value, err := strconv.ParseUint(release, 10, 32)
+	if err != nil {
+		return fmt.Errorf("cannot bump release number in %s: %s", path, err.Error())
+	}
+
+	var result bytes.Buffer
+	result.Write(buf[:match[4]])
+	result.WriteString(prefix + strconv.FormatUint(value+1, 10))
+	result.Write(buf[match[5]:])
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, result.Bytes(), fi.Mode())
+}
+
+// resolveRelativeTo resolves a path that appears in a package definition
+// relative to the directory containing that package definition.
+func resolveRelativeTo(definitionPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(definitionPath), path)
+}
@@ -0,0 +1,87 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBumpReleaseInFile(t *testing.T) {
+	dirPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirPath)
+	path := filepath.Join(dirPath, "PKGBUILD")
+
+	testCases := []struct {
+		Regex    *regexp.Regexp
+		Input    string
+		Expected string
+		Error    string
+	}{
+		{pkgbuildReleaseRx, "pkgver=1.0\npkgrel=1\narch=(any)\n", "pkgver=1.0\npkgrel=2\narch=(any)\n", ""},
+		{pkgbuildReleaseRx, "pkgrel=9\n", "pkgrel=10\n", ""},
+		//quoted values keep their quotes
+		{pkgbuildReleaseRx, "pkgrel=\"3\"\n", "pkgrel=\"4\"\n", ""},
+		{pkgbuildReleaseRx, "pkgrel='3'  \n", "pkgrel='4'  \n", ""},
+		//subreleases are incremented instead of the release
+		{pkgbuildReleaseRx, "pkgrel=2.1\n", "pkgrel=2.2\n", ""},
+		{pkgbuildReleaseRx, "pkgrel='2.9'\n", "pkgrel='2.10'\n", ""},
+		//only the first pkgrel at the start of a line is bumped
+		{pkgbuildReleaseRx, "# pkgrel=5\npkgrel=1\npkgrel=1\n", "# pkgrel=5\npkgrel=2\npkgrel=1\n", ""},
+		//no (usable) pkgrel
+		{pkgbuildReleaseRx, "pkgver=1.0\n", "", "no release number found"},
+		{pkgbuildReleaseRx, "pkgrel=$_rel\n", "", "no release number found"},
+		{pkgbuildReleaseRx, "pkgrel=99999999999\n", "", "value out of range"},
+		//holo-build package definitions
+		{holoBuildReleaseRx, "[package]\nname = \"foo\"\nversion = \"1.0\"\nrelease = 4\n", "[package]\nname = \"foo\"\nversion = \"1.0\"\nrelease = 5\n", ""},
+		{holoBuildReleaseRx, "[package]\nname = \"foo\"\n", "", "no release number found"},
+	}
+
+	for _, c := range testCases {
+		err := ioutil.WriteFile(path, []byte(c.Input), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bumpReleaseInFile(path, c.Regex)
+		if c.Error != "" {
+			if err == nil || !strings.Contains(err.Error(), c.Error) {
+				t.Errorf("expected error containing %q for %q, got %v", c.Error, c.Input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", c.Input, err.Error())
+			continue
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != c.Expected {
+			t.Errorf("expected %q to be bumped to %q, got %q", c.Input, c.Expected, string(buf))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readPackageFile reads the package file at the given path, and returns the
+// entry that repo-add(8) would generate for it, including the list of files.
+func readPackageFile(path string) (RepositoryEntry, error) {
+	entry := RepositoryEntry{FileName: filepath.Base(path)}
+
+	//compute size and digests of the package file
+	file, err := os.Open(path)
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	entry.CompressedSize, err = io.Copy(io.MultiWriter(md5Hash, sha256Hash), file)
+	file.Close()
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	entry.MD5Digest = hex.EncodeToString(md5Hash.Sum(nil))
+	entry.SHA256Digest = hex.EncodeToString(sha256Hash.Sum(nil))
+
+	//read .PKGINFO and the list of files from the package archive
+	reader, err := openDecompressed(path)
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	tr := tar.NewReader(reader)
+	foundPkginfo := false
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			reader.Close()
+			return RepositoryEntry{}, fmt.Errorf("error reading %s: %s", path, err.Error())
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if name == ".PKGINFO" {
+			buf, err := ioutil.ReadAll(tr)
+			if err == nil {
+				err = entry.parsePkginfo(buf)
+			}
+			if err != nil {
+				reader.Close()
+				return RepositoryEntry{}, fmt.Errorf("error reading %s: in .PKGINFO: %s", path, err.Error())
+			}
+			foundPkginfo = true
+			continue
+		}
+		//metadata files like .PKGINFO, .MTREE or .INSTALL are not listed
+		if name == "" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		entry.Files = append(entry.Files, name)
+	}
+	err = reader.Close()
+	if err != nil {
+		return RepositoryEntry{}, err
+	}
+	if !foundPkginfo {
+		return RepositoryEntry{}, fmt.Errorf("error reading %s: no .PKGINFO found", path)
+	}
+
+	sort.Strings(entry.Files)
+	return entry, nil
+}
+
+// parsePkginfo parses the contents of a .PKGINFO file into the given entry.
+func (entry *RepositoryEntry) parsePkginfo(buf []byte) error {
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("malformed line: %q", line)
+		}
+		key, value := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+
+		var err error
+		switch key {
+		case "pkgname":
+			entry.PackageName = value
+		case "pkgbase":
+			entry.PackageBase = value
+		case "pkgver":
+			entry.Version = value
+		case "pkgdesc":
+			entry.Description = value
+		case "group":
+			entry.Groups = append(entry.Groups, value)
+		case "size":
+			entry.InstalledSize, err = strconv.ParseInt(value, 10, 64)
+		case "url":
+			entry.URL = value
+		case "license":
+			entry.Licenses = append(entry.Licenses, value)
+		case "arch":
+			entry.Architecture = value
+		case "builddate":
+			var timestamp int64
+			timestamp, err = strconv.ParseInt(value, 10, 64)
+			entry.BuildDate = time.Unix(timestamp, 0).UTC()
+		case "packager":
+			entry.Packager = value
+		case "replaces":
+			entry.Replaces = append(entry.Replaces, value)
+		case "conflict":
+			entry.Conflicts = append(entry.Conflicts, value)
+		case "provides":
+			entry.Provides = append(entry.Provides, value)
+		case "depend":
+			entry.Depends = append(entry.Depends, value)
+		case "optdepend":
+			entry.OptDepends = append(entry.OptDepends, value)
+		case "makedepend":
+			entry.MakeDepends = append(entry.MakeDepends, value)
+		case "checkdepend":
+			entry.CheckDepends = append(entry.CheckDepends, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", key, err.Error())
+		}
+	}
+	if entry.PackageName == "" || entry.Version == "" {
+		return errors.New("missing pkgname or pkgver")
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// scanPackageLibraries reads the given package file and returns the sonames
+// of all shared libraries that its ELF files link against (DT_NEEDED), the
+// names of all shared libraries contained in it, and the absolute library
+// search paths from the DT_RUNPATH and DT_RPATH of its ELF files.
+func scanPackageLibraries(path string) (needed, provided, runPaths []string, err error) {
+	reader, err := openDecompressed(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer reader.Close()
+
+	isNeeded := make(map[string]bool)
+	isProvided := make(map[string]bool)
+	isRunPath := make(map[string]bool)
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+		}
+
+		baseName := filepath.Base(hdr.Name)
+		if strings.HasPrefix(baseName, "lib") && strings.Contains(baseName, ".so") {
+			isProvided[baseName] = true
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		//only ELF files are of interest
+		br := bufio.NewReader(tr)
+		magic, err := br.Peek(len(elf.ELFMAG))
+		if err != nil || string(magic) != elf.ELFMAG {
+			continue
+		}
+		buf, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("cannot read %s: %s", path, err.Error())
+		}
+		f, err := elf.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			continue //not a valid ELF file after all
+		}
+		libs, err := f.ImportedLibraries()
+		if err == nil {
+			for _, lib := range libs {
+				isNeeded[lib] = true
+			}
+		}
+		for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+			values, err := f.DynString(tag)
+			if err != nil {
+				continue
+			}
+			for _, value := range values {
+				for _, dir := range strings.Split(value, ":") {
+					//paths relative to $ORIGIN point into the package itself
+					if strings.HasPrefix(dir, "/") {
+						isRunPath[filepath.Clean(dir)] = true
+					}
+				}
+			}
+		}
+		f.Close()
+	}
+
+	return sortedKeys(isNeeded), sortedKeys(isProvided), sortedKeys(isRunPath), nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for key := range set {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// defaultLibraryDirs are the directories where the dynamic linker looks for
+// shared libraries, in addition to those from /etc/ld.so.conf. (On Arch Linux,
+// most of these are symlinks to /usr/lib.)
+var defaultLibraryDirs = []string{"/lib", "/lib64", "/usr/lib", "/usr/lib32", "/usr/lib64"}
+
+// readLibraryDirs returns the directories where the dynamic linker in the
+// system below the given root path looks for shared libraries.
+func readLibraryDirs(rootPath string) ([]string, error) {
+	dirs := append([]string(nil), defaultLibraryDirs...)
+	var readConfig func(path string) error
+	readConfig = func(path string) error {
+		buf, err := ioutil.ReadFile(filepath.Join(rootPath, path))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, line := range strings.Split(string(buf), "\n") {
+			if idx := strings.Index(line, "#"); idx >= 0 {
+				line = line[:idx]
+			}
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "include ") {
+				if line != "" {
+					dirs = append(dirs, line)
+				}
+				continue
+			}
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include "))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, err := filepath.Glob(filepath.Join(rootPath, pattern))
+			if err != nil {
+				return err
+			}
+			for _, match := range matches {
+				relPath, err := filepath.Rel(rootPath, match)
+				if err != nil {
+					return err
+				}
+				err = readConfig("/" + relPath)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := readConfig("/etc/ld.so.conf")
+	return dirs, err
+}
+
+// addLibrariesFromDir adds the names of all shared libraries in the given
+// directory below the given root path to the given set.
+func addLibrariesFromDir(set map[string]bool, rootPath, dir string) error {
+	names, err := readDirNames(filepath.Join(rootPath, dir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.Contains(name, ".so") {
+			set[name] = true
+		}
+	}
+	return nil
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	return names, err
+}
+
+// readAvailableLibraries returns the names of all shared libraries that are
+// installed in the system below the given root path.
+func readAvailableLibraries(rootPath string) (map[string]bool, error) {
+	dirs, err := readLibraryDirs(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool)
+	for _, dir := range dirs {
+		err := addLibrariesFromDir(result, rootPath, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// RebuildCandidate is a package file that links against shared libraries that
+// are not available anymore.
+type RebuildCandidate struct {
+	Target           *Repository
+	FileName         string
+	MissingLibraries []string
+}
+
+// checkRebuilds inspects the ELF files in all output files in the target
+// directories, and reports those package files that link against shared
+// libraries that are neither installed on the system where the package is
+// built (i.e. the host or the clean chroot) nor contained in any package in
+// the same target.
+func (s *Session) checkRebuilds() (candidates []RebuildCandidate, ok bool) {
+	availableByRoot := make(map[string]map[string]bool)
+	ok = true
+
+	for _, target := range s.Config.Targets {
+		//collect the output files of this target (but not the symlinks to
+		//output files of another architecture, since these are checked there)
+		//together with the root of the system that they are built on
+		var fileNames []string
+		rootPaths := make(map[string]string)
+		for _, src := range s.Config.Sources {
+			if src.Target != target {
+				continue
+			}
+			for _, pkg := range src.Packages {
+				entry, err := s.Cache.GetEntryForPackage(pkg)
+				if err != nil {
+					s.UI.ShowError(err)
+					ok = false
+					continue
+				}
+				rootPath := "/"
+				if native, isNative := pkg.(*NativePackage); isNative && native.Chroot != nil {
+					rootPath = filepath.Join(native.Chroot.Path, "root")
+				}
+				for _, fileName := range entry.OutputFiles {
+					fileName = s.pinnedFileName(target, fileName)
+					fileNames = append(fileNames, fileName)
+					rootPaths[fileName] = rootPath
+				}
+			}
+		}
+
+		s.UI.SetCurrentTask("Scanning packages in "+target.DisplayName(), uint(len(fileNames)))
+		entries := make(map[string]OutputCacheEntry, len(fileNames))
+		providedInTarget := make(map[string]bool)
+		for _, fileName := range fileNames {
+			s.UI.StepTask()
+			path := filepath.Join(target.Path, fileName)
+			exists, err := fileExists(path)
+			if err == nil && exists {
+				entries[fileName], err = s.Cache.GetLibrariesForOutputFile(path)
+			}
+			if err != nil {
+				s.UI.ShowError(err)
+				ok = false
+				continue
+			}
+			for _, lib := range entries[fileName].ProvidedLibraries {
+				providedInTarget[lib] = true
+			}
+		}
+		s.UI.EndTask()
+
+		for _, fileName := range fileNames {
+			entry, exists := entries[fileName]
+			if !exists || len(entry.NeededLibraries) == 0 {
+				continue
+			}
+			rootPath := rootPaths[fileName]
+			available := availableByRoot[rootPath]
+			if available == nil {
+				var err error
+				available, err = readAvailableLibraries(rootPath)
+				if err != nil {
+					s.UI.ShowError(err)
+					ok = false
+					continue
+				}
+				availableByRoot[rootPath] = available
+			}
+			availableForRunPaths := make(map[string]bool)
+			for _, dir := range entry.LibraryRunPaths {
+				err := addLibrariesFromDir(availableForRunPaths, rootPath, dir)
+				if err != nil {
+					s.UI.ShowError(err)
+					ok = false
+				}
+			}
+
+			var missing []string
+			for _, lib := range entry.NeededLibraries {
+				if !available[lib] && !providedInTarget[lib] && !availableForRunPaths[lib] {
+					missing = append(missing, lib)
+				}
+			}
+			if len(missing) > 0 {
+				candidates = append(candidates, RebuildCandidate{target, fileName, missing})
+			}
+		}
+	}
+	return
+}
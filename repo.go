@@ -19,11 +19,6 @@
 package main
 
 import (
-	"archive/tar"
-	"bytes"
-	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -34,116 +29,149 @@ import (
 type Repository struct {
 	Name string `toml:"name"`
 	Path string `toml:"path"`
+	//Builder is the default builder for all sources (see Source.Builder).
+	Builder string `toml:"builder"`
+	//Architectures is only set in the configuration file. When set, the
+	//target is expanded into one Repository per architecture (see below).
+	Architectures []string `toml:"architectures"`
+	//Architecture is set for repositories that were expanded from a target with
+	//multiple architectures. The Path of these repositories points to the
+	//"$path/os/$arch" subdirectory of the target.
+	Architecture string `toml:"-"`
+	//AnyPackagesFrom is set for all expanded repositories except for the one
+	//for the first architecture. Output files for architecture "any" are only
+	//built for the first architecture, and linked into the other
+	//architectures' repositories.
+	AnyPackagesFrom *Repository `toml:"-"`
+	//DBCompression is the compression format for newly created repository
+	//metadata archives (one of the keys of compressionByConfigName). For
+	//existing archives, the existing format is retained.
+	DBCompression string `toml:"db_compression"`
+	//DBTool selects how the repository metadata is maintained (DBToolBuiltin
+	//or DBToolRepoAdd). The default is DBToolBuiltin.
+	DBTool string `toml:"db_tool"`
+	//SignDB enables signing of the repository metadata archive and the files
+	//database with the GPGKEY from makepkg.conf.
+	SignDB bool `toml:"sign_db"`
+	//KeepVersions is the number of previous versions of each package that are
+	//kept in the archive directory (see ArchivePath) when pruning.
+	KeepVersions uint `toml:"keep_versions"`
 }
 
-// FileName returns the basename of the repository metadata archive.
-func (r Repository) FileName() string {
-	return r.Name + ".db.tar.xz"
+// DisplayName returns the name of this repository for use in messages.
+func (r Repository) DisplayName() string {
+	if r.Architecture == "" {
+		return r.Name
+	}
+	return r.Name + " (" + r.Architecture + ")"
 }
 
-// RepositoryEntry represents an entry for a package in a repo metadata archive.
-type RepositoryEntry struct {
-	PackageName string
-	FileName    string
-	MD5Digest   string
-}
+// FileName returns the basename of the repository metadata archive. If the
+// archive exists, its actual name is returned. Otherwise, the name is chosen
+// according to r.DBCompression.
+func (r Repository) FileName() string {
+	//repo-add creates a symlink "$name.db" pointing to the actual archive
+	dest, err := os.Readlink(filepath.Join(r.Path, r.Name+".db"))
+	if err == nil && filepath.Dir(dest) == "." && strings.HasPrefix(dest, r.Name+".db.tar") {
+		return dest
+	}
 
-func (r Repository) readMetadata() ([]RepositoryEntry, error) {
-	metadataPath := filepath.Join(r.Path, r.FileName())
-	file, err := os.Open(metadataPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+	for _, compression := range []Compression{CompressionXZ, CompressionZstd, CompressionGzip, CompressionBzip2, CompressionNone} {
+		fileName := r.Name + ".db.tar" + string(compression)
+		exists, err := fileExists(filepath.Join(r.Path, fileName))
+		if err == nil && exists {
+			return fileName
 		}
-		return nil, err
 	}
 
-	cmd := exec.Command("xz", "--decompress", "--stdout")
-	cmd.Stdin = file
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	if err != nil {
-		return nil, err
+	compression, exists := compressionByConfigName[r.DBCompression]
+	if !exists {
+		compression = CompressionXZ
 	}
+	return r.Name + ".db.tar" + string(compression)
+}
 
-	tr := tar.NewReader(&buf)
-	var result []RepositoryEntry
-	for {
-		hdr, err := tr.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, fmt.Errorf("error reading %s: %s", metadataPath, err.Error())
-		}
-
-		ok, entry, err := readMetadataEntry(hdr, tr)
-		if err != nil {
-			return nil, fmt.Errorf("error reading %s: %s", metadataPath, err.Error())
-		}
-		if ok {
-			result = append(result, entry)
-		}
-	}
-	return result, nil
+// readMetadata reads all entries from the repository metadata archive.
+func (r Repository) readMetadata() ([]RepositoryEntry, error) {
+	return r.readArchive(r.FileName())
 }
 
-func readMetadataEntry(h *tar.Header, r io.Reader) (ok bool, entry RepositoryEntry, err error) {
-	//entries are regular files like */desc
-	if !h.FileInfo().Mode().IsRegular() {
-		ok = false
-		return
-	}
-	if filepath.Base(h.Name) != "desc" {
-		ok = false
-		return
+// linkAnyPackages creates symlinks for all output files of r.AnyPackagesFrom
+// that are for architecture "any" (and their signatures).
+func (r Repository) linkAnyPackages(allOutputFilesOfSource []string, ui *UI) (ok bool) {
+	if r.AnyPackagesFrom == nil {
+		return true
 	}
-
-	var buf []byte
-	buf, err = ioutil.ReadAll(r)
+	relPath, err := filepath.Rel(r.Path, r.AnyPackagesFrom.Path)
 	if err != nil {
-		ok = false
-		return
+		ui.ShowError(err)
+		return false
 	}
 
-	//read line by line
-	currentField := ""
-	for _, line := range strings.Split(string(buf), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		if strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%") {
-			currentField = line
+	ok = true
+	for _, fileName := range allOutputFilesOfSource {
+		if !isAnyPackageFile(fileName) {
 			continue
 		}
-
-		switch currentField {
-		case "%NAME%":
-			entry.PackageName = line
-		case "%FILENAME%":
-			entry.FileName = line
-		case "%MD5SUM%":
-			entry.MD5Digest = line
+		for _, name := range []string{fileName, fileName + ".sig"} {
+			exists, err := fileExists(filepath.Join(r.AnyPackagesFrom.Path, name))
+			if err != nil {
+				ui.ShowError(err)
+				ok = false
+				continue
+			}
+			if exists {
+				err = ensureSymlink(filepath.Join(relPath, name), filepath.Join(r.Path, name))
+				if err != nil {
+					ui.ShowError(err)
+					ok = false
+				}
+			}
 		}
 	}
-	ok = true
 	return
 }
 
+// ensureSymlink creates a symlink at `path` pointing to `dest`, replacing
+// whatever was at `path` before.
+func ensureSymlink(dest, path string) error {
+	currentDest, err := os.Readlink(path)
+	if err == nil && currentDest == dest {
+		return nil
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(dest, path)
+}
+
 func (r Repository) addNewPackages(allOutputFiles []string, c *Cache, ui *UI) (ok bool) {
 	ui.SetCurrentTask("Adding new packages to repository", uint(len(allOutputFiles)))
 	defer ui.EndTask()
 
-	//get existing entries
-	entries, err := r.readMetadata()
+	newOutputFiles, err := r.findNewPackages(allOutputFiles, c, ui)
 	if err != nil {
 		ui.ShowError(err)
 		return false
 	}
+	if len(newOutputFiles) == 0 {
+		return true
+	}
+
+	err = r.addToMetadata(newOutputFiles)
+	ui.ShowError(err)
+	return err == nil
+}
+
+// findNewPackages returns those output files that are missing from the
+// repository metadata, or that have changed since they were added to it.
+func (r Repository) findNewPackages(allOutputFiles []string, c *Cache, ui *UI) ([]string, error) {
+	//get existing entries
+	entries, err := r.readMetadata()
+	if err != nil {
+		return nil, err
+	}
 	entryByFilename := make(map[string]RepositoryEntry, len(entries))
 	for _, entry := range entries {
 		entryByFilename[entry.FileName] = entry
@@ -161,66 +189,126 @@ func (r Repository) addNewPackages(allOutputFiles []string, c *Cache, ui *UI) (o
 
 		cacheEntry, err := c.GetEntryForOutputFile(filepath.Join(r.Path, fileName))
 		if err != nil {
-			ui.ShowError(err)
-			return false
+			return nil, err
 		}
 		if entry.MD5Digest != cacheEntry.MD5Digest {
 			newOutputFiles = append(newOutputFiles, fileName)
 		}
 	}
+	return newOutputFiles, nil
+}
 
-	if len(newOutputFiles) == 0 {
-		return true
+// addToMetadata adds the given package files to the repository metadata,
+// replacing the entries for previous versions of the same packages. The
+// package files of these previous versions are discarded.
+func (r Repository) addToMetadata(fileNames []string) error {
+	if r.DBTool != DBToolRepoAdd {
+		return r.addEntries(fileNames)
 	}
-
-	cmd := exec.Command("repo-add", append([]string{"-n", "-R", r.FileName()}, newOutputFiles...)...)
-	cmd.Dir = r.Path
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	ui.ShowError(err)
-	return err == nil
+	args := []string{"-n"}
+	if r.KeepVersions == 0 {
+		args = append(args, "-R")
+	}
+	//if old versions shall be archived, that is done by prunePackages()
+	return r.runRepoTool("repo-add", append(append(args, r.FileName()), fileNames...))
 }
 
 func (r Repository) pruneMetadata(allOutputFiles []string, ui *UI) (ok bool) {
 	ui.SetCurrentTask("Removing old entries from repo metadata", 1)
 	defer ui.EndTask()
 
-	//get existing entries
-	entries, err := r.readMetadata()
+	oldEntries, err := r.findOldEntries(allOutputFiles)
 	if err != nil {
 		ui.ShowError(err)
 		return false
 	}
+	if len(oldEntries) == 0 {
+		return true
+	}
+	entriesToDelete := make([]string, len(oldEntries))
+	for idx, entry := range oldEntries {
+		entriesToDelete[idx] = entry.PackageName
+	}
+
+	if r.DBTool == DBToolRepoAdd {
+		err = r.runRepoTool("repo-remove", append([]string{r.FileName()}, entriesToDelete...))
+	} else {
+		err = r.removeEntries(entriesToDelete)
+	}
+	ui.ShowError(err)
+	return err == nil
+}
 
-	//collect all entries that do not match a current output file
+// findOldEntries returns all entries from the repository metadata that do not
+// match a current output file.
+func (r Repository) findOldEntries(allOutputFiles []string) ([]RepositoryEntry, error) {
+	entries, err := r.readMetadata()
+	if err != nil {
+		return nil, err
+	}
 	isOutputFile := make(map[string]bool, len(allOutputFiles))
 	for _, fileName := range allOutputFiles {
 		isOutputFile[fileName] = true
 	}
-	var entriesToDelete []string
+	var result []RepositoryEntry
 	for _, entry := range entries {
 		if !isOutputFile[entry.FileName] {
-			entriesToDelete = append(entriesToDelete, entry.PackageName)
+			result = append(result, entry)
 		}
 	}
+	return result, nil
+}
 
-	if len(entriesToDelete) == 0 {
-		return true
+// runRepoTool runs repo-add(8) or repo-remove(8) in the repository directory.
+func (r Repository) runRepoTool(command string, args []string) error {
+	//the existing signatures will not be valid anymore
+	for _, names := range r.databaseFileNames() {
+		err := r.removeSignature(names[0], names[1])
+		if err != nil {
+			return err
+		}
 	}
 
-	cmd := exec.Command("repo-remove", append([]string{r.FileName()}, entriesToDelete...)...)
+	cmd := exec.Command(command, args...)
 	cmd.Dir = r.Path
 	cmd.Stdin = nil
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
-	ui.ShowError(err)
-	return err == nil
+	return cmd.Run()
 }
 
 func (r Repository) prunePackages(allOutputFiles []string, ui *UI) (ok bool) {
+	filenamesToDelete, err := r.findOldPackageFiles(allOutputFiles)
+	if err != nil {
+		ui.ShowError(err)
+		return false
+	}
+
+	ok = true
+	if len(filenamesToDelete) > 0 {
+		ui.SetCurrentTask("Removing old files from target directory", uint(len(filenamesToDelete)))
+		for _, fileName := range filenamesToDelete {
+			ui.StepTask()
+			err := r.discardPackageFile(fileName)
+			if err != nil {
+				ui.ShowError(err)
+				ok = false
+			}
+		}
+		ui.EndTask()
+	}
+
+	if r.KeepVersions > 0 && !r.pruneArchive(ui) {
+		ok = false
+	}
+	return
+}
+
+// findOldPackageFiles returns the names of all package files in the target
+// directory that are not current output files (including those where only
+// an orphaned signature is left). discardPackageFile() takes care of both the
+// package file and its signature.
+func (r Repository) findOldPackageFiles(allOutputFiles []string) ([]string, error) {
 	isOutputFile := make(map[string]bool, len(allOutputFiles))
 	for _, fileName := range allOutputFiles {
 		isOutputFile[fileName] = true
@@ -228,39 +316,22 @@ func (r Repository) prunePackages(allOutputFiles []string, ui *UI) (ok bool) {
 
 	dir, err := os.Open(r.Path)
 	if err != nil {
-		ui.ShowError(err)
-		return false
+		return nil, err
 	}
 	names, err := dir.Readdirnames(-1)
+	dir.Close()
 	if err != nil {
-		ui.ShowError(err)
-		return false
+		return nil, err
 	}
-	var filenamesToDelete []string
+
+	var result []string
+	isOld := make(map[string]bool)
 	for _, fullFileName := range names {
 		fileName := strings.TrimSuffix(fullFileName, ".sig")
-		if strings.HasSuffix(fileName, ".pkg.tar.xz") && !isOutputFile[fileName] {
-			filenamesToDelete = append(filenamesToDelete, fullFileName)
-			continue
-		}
-	}
-
-	if len(filenamesToDelete) == 0 {
-		return true
-	}
-
-	ui.SetCurrentTask("Removing old files from target directory", uint(len(filenamesToDelete)))
-	defer ui.EndTask()
-
-	ok = true
-	for _, fileName := range filenamesToDelete {
-		ui.StepTask()
-		err := os.Remove(filepath.Join(r.Path, fileName))
-		if err != nil {
-			ui.ShowError(err)
-			ok = false
+		if isPackageFile(fileName) && !isOutputFile[fileName] && !isOld[fileName] {
+			result = append(result, fileName)
+			isOld[fileName] = true
 		}
 	}
-
-	return
+	return result, nil
 }
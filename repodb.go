@@ -0,0 +1,503 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//DBToolBuiltin maintains the repository metadata with ART's own
+	//implementation.
+	DBToolBuiltin = "builtin"
+	//DBToolRepoAdd maintains the repository metadata with repo-add(8) and
+	//repo-remove(8).
+	DBToolRepoAdd = "repo-add"
+)
+
+// compression returns the compression format of the repository metadata
+// archives.
+func (r Repository) compression() Compression {
+	return Compression(strings.TrimPrefix(r.FileName(), r.Name+".db.tar"))
+}
+
+// FilesFileName returns the basename of the files database, which has the
+// same compression format as the repository metadata archive.
+func (r Repository) FilesFileName() string {
+	return r.Name + ".files.tar" + string(r.compression())
+}
+
+// readArchive reads all entries from the given repository metadata archive
+// or files database. If the archive does not exist, an empty list is returned.
+func (r Repository) readArchive(fileName string) ([]RepositoryEntry, error) {
+	archivePath := filepath.Join(r.Path, fileName)
+	reader, err := openDecompressed(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	//each entry is a directory "$pkgname-$pkgver/" containing a file "desc"
+	//(and, in older formats, also a file "depends"; and in files databases,
+	//also a file "files")
+	tr := tar.NewReader(reader)
+	var result []RepositoryEntry
+	indexByDir := make(map[string]int)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			reader.Close()
+			return nil, fmt.Errorf("error reading %s: %s", archivePath, err.Error())
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		fileName := path.Base(hdr.Name)
+		if fileName != "desc" && fileName != "depends" && fileName != "files" {
+			continue
+		}
+
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("error reading %s: %s", archivePath, err.Error())
+		}
+		dir := path.Dir(hdr.Name)
+		idx, exists := indexByDir[dir]
+		if !exists {
+			idx = len(result)
+			indexByDir[dir] = idx
+			result = append(result, RepositoryEntry{})
+		}
+		err = result[idx].parseDesc(buf)
+		if err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("error reading %s: in %s: %s", archivePath, hdr.Name, err.Error())
+		}
+	}
+	return result, reader.Close()
+}
+
+// readMetadataWithFiles is like readMetadata, but also fills the Files of each
+// entry from the files database. When the files database does not have a
+// matching entry (with the same file name and checksum), the file list is read
+// from the package file instead.
+func (r Repository) readMetadataWithFiles() ([]RepositoryEntry, error) {
+	entries, err := r.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	filesEntries, err := r.readArchive(r.FilesFileName())
+	if err != nil {
+		return nil, err
+	}
+	filesEntryByFileName := make(map[string]RepositoryEntry, len(filesEntries))
+	for _, entry := range filesEntries {
+		filesEntryByFileName[entry.FileName] = entry
+	}
+
+	for idx, entry := range entries {
+		filesEntry, exists := filesEntryByFileName[entry.FileName]
+		if exists && filesEntry.hasFileList && filesEntry.SHA256Digest == entry.SHA256Digest && filesEntry.MD5Digest == entry.MD5Digest {
+			entries[idx].Files = filesEntry.Files
+			continue
+		}
+		pkgEntry, err := readPackageFile(filepath.Join(r.Path, entry.FileName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		entries[idx].Files = pkgEntry.Files
+	}
+	return entries, nil
+}
+
+// checkFilesDatabase verifies that the files database has the same entries as
+// the repository metadata archive, and regenerates it otherwise (e.g. when it
+// was deleted, or when it was not updated by an older version of ART).
+func (r Repository) checkFilesDatabase(ui *UI) (ok bool) {
+	ui.SetCurrentTask("Checking files database", 1)
+	defer ui.EndTask()
+
+	entries, err := r.readMetadata()
+	if err != nil {
+		ui.ShowError(err)
+		return false
+	}
+	filesEntries, err := r.readArchive(r.FilesFileName())
+	if err != nil {
+		ui.ShowError(err)
+		return false
+	}
+	ui.StepTask()
+
+	problem := compareFilesDatabase(entries, filesEntries)
+	if problem == "" {
+		return true
+	}
+	if len(entries) == 0 {
+		//the repository metadata archive might not exist yet
+		exists, err := fileExists(filepath.Join(r.Path, r.FileName()))
+		if err != nil {
+			ui.ShowError(err)
+			return false
+		}
+		if !exists {
+			return true
+		}
+	}
+
+	ui.ShowWarning("%s: %s; regenerating it", filepath.Join(r.Path, r.FilesFileName()), problem)
+	entries, err = r.readMetadataWithFiles()
+	if err == nil {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].DirName() < entries[j].DirName() })
+		err = r.writeArchive(r.FilesFileName(), r.Name+".files", entries, true)
+	}
+	ui.ShowError(err)
+	return err == nil
+}
+
+// compareFilesDatabase checks whether the given entries from a files database
+// match the given entries from a repository metadata archive. If not, a
+// description of the first difference is returned.
+func compareFilesDatabase(entries, filesEntries []RepositoryEntry) string {
+	filesEntryByFileName := make(map[string]RepositoryEntry, len(filesEntries))
+	for _, entry := range filesEntries {
+		filesEntryByFileName[entry.FileName] = entry
+	}
+	for _, entry := range entries {
+		filesEntry, exists := filesEntryByFileName[entry.FileName]
+		if !exists {
+			return "missing entry for " + entry.FileName
+		}
+		if !filesEntry.hasFileList {
+			return "missing file list for " + entry.FileName
+		}
+		if !bytes.Equal(entry.formatDesc(), filesEntry.formatDesc()) {
+			return "outdated entry for " + entry.FileName
+		}
+		delete(filesEntryByFileName, entry.FileName)
+	}
+	for fileName := range filesEntryByFileName {
+		return "unexpected entry for " + fileName
+	}
+	return ""
+}
+
+// addEntries adds the given package files to the repository metadata. Existing
+// entries for the same package names are replaced, and the package files that
+// they refer to are discarded (like `repo-add -R` does, but see
+// discardPackageFile).
+func (r Repository) addEntries(fileNames []string) error {
+	entries, err := r.readMetadataWithFiles()
+	if err != nil {
+		return err
+	}
+	indexByName := make(map[string]int, len(entries))
+	for idx, entry := range entries {
+		indexByName[entry.PackageName] = idx
+	}
+
+	var obsoleteFileNames []string
+	for _, fileName := range fileNames {
+		entry, err := readPackageFile(filepath.Join(r.Path, fileName))
+		if err != nil {
+			return err
+		}
+		idx, exists := indexByName[entry.PackageName]
+		if !exists {
+			indexByName[entry.PackageName] = len(entries)
+			entries = append(entries, entry)
+			continue
+		}
+		if entries[idx].FileName != entry.FileName {
+			obsoleteFileNames = append(obsoleteFileNames, entries[idx].FileName)
+		}
+		entries[idx] = entry
+	}
+
+	err = r.writeMetadata(entries)
+	if err != nil {
+		return err
+	}
+	for _, fileName := range obsoleteFileNames {
+		err := r.discardPackageFile(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEntries removes the entries for the given package names from the
+// repository metadata.
+func (r Repository) removeEntries(packageNames []string) error {
+	entries, err := r.readMetadataWithFiles()
+	if err != nil {
+		return err
+	}
+	isRemoved := make(map[string]bool, len(packageNames))
+	for _, name := range packageNames {
+		isRemoved[name] = true
+	}
+	var remaining []RepositoryEntry
+	for _, entry := range entries {
+		if !isRemoved[entry.PackageName] {
+			remaining = append(remaining, entry)
+		}
+	}
+	return r.writeMetadata(remaining)
+}
+
+// writeMetadata replaces the repository metadata archive and the files
+// database with new ones containing the given entries. Each archive is
+// replaced atomically.
+func (r Repository) writeMetadata(entries []RepositoryEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DirName() < entries[j].DirName() })
+
+	//write the files database first, so that the repository metadata archive
+	//never refers to packages that are missing from the files database
+	err := r.writeArchive(r.FilesFileName(), r.Name+".files", entries, true)
+	if err != nil {
+		return err
+	}
+	return r.writeArchive(r.FileName(), r.Name+".db", entries, false)
+}
+
+// writeArchive writes the given entries into a new archive. The archive is
+// written into a temporary file first, then moved to its final location. A
+// symlink (like "$name.db") pointing to it is created as well.
+func (r Repository) writeArchive(fileName, linkName string, entries []RepositoryEntry, withFiles bool) (returnedErr error) {
+	tmpFile, err := ioutil.TempFile(r.Path, ".art-"+fileName+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if returnedErr != nil {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	cw, err := newCompressedWriter(tmpFile, r.compression())
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	now := time.Now()
+	writeFile := func(name string, buf []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(buf)),
+			ModTime:  now,
+		})
+		if err == nil {
+			_, err = tw.Write(buf)
+		}
+		return err
+	}
+	for _, entry := range entries {
+		dirName := entry.DirName()
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dirName + "/",
+			Mode:     0755,
+			ModTime:  now,
+		})
+		if err == nil {
+			err = writeFile(dirName+"/desc", entry.formatDesc())
+		}
+		if err == nil && withFiles {
+			err = writeFile(dirName+"/files", entry.formatFiles())
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tw.Close()
+	}
+	//always close these to clean up external compression programs
+	if cwErr := cw.Close(); err == nil {
+		err = cwErr
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %s", filepath.Join(r.Path, fileName), err.Error())
+	}
+
+	err = os.Chmod(tmpFile.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = r.removeSignature(fileName, linkName)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), filepath.Join(r.Path, fileName))
+	if err != nil {
+		return err
+	}
+	return ensureSymlink(fileName, filepath.Join(r.Path, linkName))
+}
+
+// databaseFileNames returns the file names of the repository metadata archive
+// and the files database, each together with the name of the symlink pointing
+// to it.
+func (r Repository) databaseFileNames() [][2]string {
+	return [][2]string{
+		{r.FileName(), r.Name + ".db"},
+		{r.FilesFileName(), r.Name + ".files"},
+	}
+}
+
+// removeSignature removes the signature of the given archive, as well as the
+// symlink to it.
+func (r Repository) removeSignature(fileName, linkName string) error {
+	for _, name := range []string{fileName + ".sig", linkName + ".sig"} {
+		err := os.Remove(filepath.Join(r.Path, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// signDatabases creates signatures for the repository metadata archive and the
+// files database if r.SignDB is set. Signatures are only created if they are
+// missing (they are removed whenever an archive is rewritten) or older than
+// the archive.
+func (r Repository) signDatabases(signer Signer, ui *UI) (ok bool) {
+	if !r.SignDB {
+		return true
+	}
+	ui.SetCurrentTask("Signing repository metadata", 2)
+	defer ui.EndTask()
+
+	if signer == nil {
+		ui.ShowError(fmt.Errorf("cannot sign repository metadata of %s: %s", r.DisplayName(), errSigningNotConfigured.Error()))
+		return false
+	}
+
+	ok = true
+	for _, names := range r.databaseFileNames() {
+		ui.StepTask()
+		fileName, linkName := names[0], names[1]
+		err := r.signDatabase(fileName, linkName, signer)
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+		}
+	}
+	return
+}
+
+func (r Repository) signDatabase(fileName, linkName string, signer Signer) error {
+	path := filepath.Join(r.Path, fileName)
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sigFI, err := os.Stat(path + ".sig")
+	switch {
+	case err == nil:
+		if sigFI.ModTime().Before(fi.ModTime()) {
+			//the archive was changed by someone else
+			err := r.removeSignature(fileName, linkName)
+			if err != nil {
+				return err
+			}
+			err = signer.Sign(path)
+			if err != nil {
+				return err
+			}
+		}
+	case os.IsNotExist(err):
+		err := signer.Sign(path)
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	return ensureSymlink(fileName+".sig", filepath.Join(r.Path, linkName+".sig"))
+}
+
+// verifyDatabaseSignatures verifies the existing signatures of the repository
+// metadata archive and the files database. Invalid signatures are replaced if
+// `resign` is true, or reported as an error otherwise.
+func (r Repository) verifyDatabaseSignatures(signer Signer, resign bool, ui *UI) (ok bool) {
+	ok = true
+	for _, names := range r.databaseFileNames() {
+		path := filepath.Join(r.Path, names[0])
+		exists, err := fileExists(path + ".sig")
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+			continue
+		}
+		if !exists {
+			continue
+		}
+		err = signer.Verify(path)
+		if err == nil {
+			continue
+		}
+		if !resign {
+			ui.ShowError(err)
+			ok = false
+			continue
+		}
+		ui.ShowWarning("%s; signing again", err.Error())
+		err = resignFile(signer, path)
+		if err == nil {
+			err = ensureSymlink(names[0]+".sig", filepath.Join(r.Path, names[1]+".sig"))
+		}
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+		}
+	}
+	return
+}
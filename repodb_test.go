@@ -0,0 +1,351 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestPackage creates a gzip-compressed package file in the given
+// directory, with the given .PKGINFO and the given (empty) files.
+func writeTestPackage(t *testing.T, dirPath, fileName, pkginfo string, files []string) {
+	t.Helper()
+	file, err := os.Create(filepath.Join(dirPath, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(file)
+	tw := tar.NewWriter(gw)
+	modTime := time.Unix(1700000000, 0)
+	write := func(name string, buf []byte) {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(buf)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		}
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = tw.Write(buf)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".PKGINFO", []byte(pkginfo))
+	write(".MTREE", []byte("not a real mtree"))
+	for _, name := range files {
+		write(name, nil)
+	}
+	for _, c := range []io.Closer{tw, gw, file} {
+		err := c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestArchive returns the contents of all regular files in the given
+// archive, keyed by path.
+func readTestArchive(t *testing.T, path string) map[string]string {
+	t.Helper()
+	reader, err := openDecompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	result := make(map[string]string)
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[hdr.Name] = string(buf)
+	}
+}
+
+// fileDigests returns the size, MD5 and SHA256 digest of the given file, as
+// written into the "desc" file by repo-add.
+func fileDigests(t *testing.T, path string) (size int, md5Digest, sha256Digest string) {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5Sum := md5.Sum(buf)
+	sha256Sum := sha256.Sum256(buf)
+	return len(buf), hex.EncodeToString(md5Sum[:]), hex.EncodeToString(sha256Sum[:])
+}
+
+const testPkginfoFoo = `# Generated by makepkg
+pkgname = foo
+pkgbase = foo-base
+pkgver = %s
+pkgdesc = The foo package
+url = https://example.org/foo
+builddate = 1700000000
+packager = Jane Doe <jane@example.org>
+size = 4096
+arch = x86_64
+license = GPL
+license = MIT
+group = foobar
+provides = libfoo.so=1-64
+conflict = foo-git
+depend = glibc
+depend = bar>=1
+optdepend = baz: for extra features
+makedepend = cmake
+`
+
+const testPkginfoBar = `pkgname = bar
+pkgver = 1-1
+pkgdesc = The bar package
+builddate = 1700000000
+packager = Jane Doe <jane@example.org>
+size = 512
+arch = any
+`
+
+// expected "desc" file for foo, as repo-add would write it
+const testDescFoo = `%%FILENAME%%
+%s
+
+%%NAME%%
+foo
+
+%%BASE%%
+foo-base
+
+%%VERSION%%
+%s
+
+%%DESC%%
+The foo package
+
+%%GROUPS%%
+foobar
+
+%%CSIZE%%
+%d
+
+%%ISIZE%%
+4096
+
+%%MD5SUM%%
+%s
+
+%%SHA256SUM%%
+%s
+
+%%URL%%
+https://example.org/foo
+
+%%LICENSE%%
+GPL
+MIT
+
+%%ARCH%%
+x86_64
+
+%%BUILDDATE%%
+1700000000
+
+%%PACKAGER%%
+Jane Doe <jane@example.org>
+
+%%CONFLICTS%%
+foo-git
+
+%%PROVIDES%%
+libfoo.so=1-64
+
+%%DEPENDS%%
+glibc
+bar>=1
+
+%%OPTDEPENDS%%
+baz: for extra features
+
+%%MAKEDEPENDS%%
+cmake
+
+`
+
+// expected "desc" file for bar (fields without values are omitted)
+const testDescBar = `%%FILENAME%%
+bar-1-1-any.pkg.tar.gz
+
+%%NAME%%
+bar
+
+%%VERSION%%
+1-1
+
+%%DESC%%
+The bar package
+
+%%CSIZE%%
+%d
+
+%%ISIZE%%
+512
+
+%%MD5SUM%%
+%s
+
+%%SHA256SUM%%
+%s
+
+%%ARCH%%
+any
+
+%%BUILDDATE%%
+1700000000
+
+%%PACKAGER%%
+Jane Doe <jane@example.org>
+
+`
+
+func TestRepositoryEntriesRoundTrip(t *testing.T) {
+	dirPath := t.TempDir()
+	r := Repository{Name: "test", Path: dirPath, DBCompression: "gz"}
+
+	fooFiles := []string{"usr/", "usr/bin/", "usr/bin/foo", "usr/share/foo/README"}
+	writeTestPackage(t, dirPath, "foo-1.0-1-x86_64.pkg.tar.gz", fmt.Sprintf(testPkginfoFoo, "1.0-1"), fooFiles)
+	writeTestPackage(t, dirPath, "bar-1-1-any.pkg.tar.gz", testPkginfoBar, []string{"./etc/", "./etc/bar.conf"})
+
+	//add both packages to a new repository
+	err := r.addEntries([]string{"foo-1.0-1-x86_64.pkg.tar.gz", "bar-1-1-any.pkg.tar.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range r.databaseFileNames() {
+		dest, err := os.Readlink(filepath.Join(dirPath, names[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != names[0] {
+			t.Errorf("expected %s to point to %s, but points to %s", names[1], names[0], dest)
+		}
+	}
+
+	fooSize, fooMD5, fooSHA256 := fileDigests(t, filepath.Join(dirPath, "foo-1.0-1-x86_64.pkg.tar.gz"))
+	barSize, barMD5, barSHA256 := fileDigests(t, filepath.Join(dirPath, "bar-1-1-any.pkg.tar.gz"))
+	fooDesc := fmt.Sprintf(testDescFoo, "foo-1.0-1-x86_64.pkg.tar.gz", "1.0-1", fooSize, fooMD5, fooSHA256)
+	barDesc := fmt.Sprintf(testDescBar, barSize, barMD5, barSHA256)
+	expectArchive(t, filepath.Join(dirPath, "test.db.tar.gz"), map[string]string{
+		"bar-1-1/desc":   barDesc,
+		"foo-1.0-1/desc": fooDesc,
+	})
+	expectArchive(t, filepath.Join(dirPath, "test.files.tar.gz"), map[string]string{
+		"bar-1-1/desc":    barDesc,
+		"bar-1-1/files":   "%FILES%\netc/\netc/bar.conf\n",
+		"foo-1.0-1/desc":  fooDesc,
+		"foo-1.0-1/files": "%FILES%\nusr/\nusr/bin/\nusr/bin/foo\nusr/share/foo/README\n",
+	})
+
+	//reading the metadata back must yield the same entries
+	entries, err := r.readMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	pkgEntry, err := readPackageFile(filepath.Join(dirPath, "foo-1.0-1-x86_64.pkg.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgEntry.Files = nil
+	if !reflect.DeepEqual(entries[1], pkgEntry) {
+		t.Errorf("expected entry %#v, got %#v", pkgEntry, entries[1])
+	}
+
+	//adding a new version replaces the entry and removes the old package file
+	writeTestPackage(t, dirPath, "foo-1.0-2-x86_64.pkg.tar.gz", fmt.Sprintf(testPkginfoFoo, "1.0-2"), fooFiles)
+	err = r.addEntries([]string{"foo-1.0-2-x86_64.pkg.tar.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, err := fileExists(filepath.Join(dirPath, "foo-1.0-1-x86_64.pkg.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("expected old package file to be removed")
+	}
+	fooSize, fooMD5, fooSHA256 = fileDigests(t, filepath.Join(dirPath, "foo-1.0-2-x86_64.pkg.tar.gz"))
+	fooDesc = fmt.Sprintf(testDescFoo, "foo-1.0-2-x86_64.pkg.tar.gz", "1.0-2", fooSize, fooMD5, fooSHA256)
+	expectArchive(t, filepath.Join(dirPath, "test.db.tar.gz"), map[string]string{
+		"bar-1-1/desc":   barDesc,
+		"foo-1.0-2/desc": fooDesc,
+	})
+
+	//removing an entry
+	err = r.removeEntries([]string{"bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectArchive(t, filepath.Join(dirPath, "test.db.tar.gz"), map[string]string{
+		"foo-1.0-2/desc": fooDesc,
+	})
+	expectArchive(t, filepath.Join(dirPath, "test.files.tar.gz"), map[string]string{
+		"foo-1.0-2/desc":  fooDesc,
+		"foo-1.0-2/files": "%FILES%\nusr/\nusr/bin/\nusr/bin/foo\nusr/share/foo/README\n",
+	})
+}
+
+func expectArchive(t *testing.T, path string, expected map[string]string) {
+	t.Helper()
+	actual := readTestArchive(t, path)
+	for name, content := range expected {
+		if actual[name] != content {
+			t.Errorf("%s: expected %s to contain %q, got %q", path, name, content, actual[name])
+		}
+	}
+	for name := range actual {
+		if _, exists := expected[name]; !exists {
+			t.Errorf("%s: unexpected file %s", path, name)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// PackageState is the result of building a package, as shown in the Report.
+type PackageState string
+
+// Possible values for PackageState.
+const (
+	//PackageSkipped means that the package was up to date.
+	PackageSkipped PackageState = "skipped"
+	//PackageBuilt means that the package was built successfully.
+	PackageBuilt PackageState = "built"
+	//PackageFailed means that the package could not be built, either because
+	//the build failed or because one of its dependencies could not be built.
+	PackageFailed PackageState = "failed"
+)
+
+var packageStates = []PackageState{PackageBuilt, PackageFailed, PackageSkipped}
+
+// SignatureState describes whether the output files of a package are signed.
+type SignatureState string
+
+// Possible values for SignatureState.
+const (
+	//SignatureNone means that the package has no output files.
+	SignatureNone SignatureState = "none"
+	//SignatureSigned means that all output files are signed.
+	SignatureSigned SignatureState = "signed"
+	//SignaturePartial means that only some output files are signed.
+	SignaturePartial SignatureState = "partial"
+	//SignatureMissing means that no output file is signed.
+	SignatureMissing SignatureState = "unsigned"
+)
+
+// PackageResult is the result of building one package.
+type PackageResult struct {
+	Package         string         `json:"package"`
+	Target          string         `json:"target"`
+	Architecture    string         `json:"architecture,omitempty"`
+	State           PackageState   `json:"state"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	OutputFiles     []string       `json:"output_files"`
+	Signatures      SignatureState `json:"signatures"`
+	Error           string         `json:"error,omitempty"`
+	LogPath         string         `json:"log_path,omitempty"`
+	targetPath      string
+}
+
+// OperationResult is the result of an operation on a repository (e.g.
+// publishing or pruning).
+type OperationResult struct {
+	Target       string `json:"target"`
+	Architecture string `json:"architecture,omitempty"`
+	Operation    string `json:"operation"`
+	OK           bool   `json:"ok"`
+}
+
+// Report collects the results of all packages and repository operations during
+// one run, to show a summary at the end of the run. All methods do nothing if
+// the Report is nil (e.g. during a dry run). It is safe for concurrent use.
+type Report struct {
+	Packages   []PackageResult
+	Operations []OperationResult
+	//JSONPath and JUnitPath are set when the report shall be written into a
+	//file in the respective format.
+	JSONPath  string
+	JUnitPath string
+	startTime time.Time
+	mutex     sync.Mutex
+}
+
+func newReport() *Report {
+	return &Report{startTime: time.Now()}
+}
+
+// addPackage records the result of building the package in the given node.
+func (r *Report) addPackage(node *BuildNode, result PackageResult) {
+	if r == nil {
+		return
+	}
+	result.Package = node.Package.CacheKey()
+	if len(node.Entry.Relations.Names) > 0 {
+		result.Package = node.Entry.Relations.Names[0]
+	}
+	result.Target = node.Target.Name
+	result.Architecture = node.Target.Architecture
+	result.targetPath = node.Target.Path
+	if result.OutputFiles == nil {
+		result.OutputFiles = []string{}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Packages = append(r.Packages, result)
+}
+
+// addOperation records the result of an operation on the given repository.
+func (r *Report) addOperation(target *Repository, operation string, ok bool) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Operations = append(r.Operations, OperationResult{
+		Target:       target.Name,
+		Architecture: target.Architecture,
+		Operation:    operation,
+		OK:           ok,
+	})
+}
+
+// Finish checks the signatures of all output files, prints the summary and
+// writes the report files (if requested).
+func (r *Report) Finish(ui *UI) (ok bool) {
+	if r == nil {
+		return true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	ok = true
+	for idx, result := range r.Packages {
+		state, err := checkSignatureState(result.targetPath, result.OutputFiles)
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+		}
+		r.Packages[idx].Signatures = state
+	}
+
+	err := r.printSummary(ui.writer())
+	if err != nil {
+		ui.ShowError(err)
+		ok = false
+	}
+	if r.JSONPath != "" {
+		err := r.writeFile(r.JSONPath, r.writeJSON)
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+		}
+	}
+	if r.JUnitPath != "" {
+		err := r.writeFile(r.JUnitPath, r.writeJUnit)
+		if err != nil {
+			ui.ShowError(err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// checkSignatureState checks whether the given output files in the given
+// target directory have signatures.
+func checkSignatureState(targetPath string, outputFiles []string) (SignatureState, error) {
+	if len(outputFiles) == 0 {
+		return SignatureNone, nil
+	}
+	signedCount := 0
+	for _, fileName := range outputFiles {
+		exists, err := fileExists(filepath.Join(targetPath, fileName+".sig"))
+		if err != nil {
+			return SignatureNone, err
+		}
+		if exists {
+			signedCount++
+		}
+	}
+	switch signedCount {
+	case 0:
+		return SignatureMissing, nil
+	case len(outputFiles):
+		return SignatureSigned, nil
+	default:
+		return SignaturePartial, nil
+	}
+}
+
+func (r *Report) countPackages() map[PackageState]int {
+	counts := make(map[PackageState]int)
+	for _, result := range r.Packages {
+		counts[result.State]++
+	}
+	return counts
+}
+
+func (r *Report) countFailedOperations() (count int) {
+	for _, op := range r.Operations {
+		if !op.OK {
+			count++
+		}
+	}
+	return
+}
+
+func displayTarget(name, arch string) string {
+	if arch == "" {
+		return name
+	}
+	return name + " (" + arch + ")"
+}
+
+// printSummary prints a table of all packages that were built or failed, and of
+// all repository operations, followed by the number of packages in each state.
+func (r *Report) printSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	counts := r.countPackages()
+	if counts[PackageBuilt]+counts[PackageFailed] > 0 {
+		fmt.Fprintf(tw, "\nPACKAGE\tTARGET\tRESULT\tDURATION\tFILES\tSIGNATURES\n")
+		for _, result := range r.Packages {
+			if result.State == PackageSkipped {
+				continue
+			}
+			duration := time.Duration(result.DurationSeconds * float64(time.Second)).Round(time.Second)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+				result.Package, displayTarget(result.Target, result.Architecture),
+				result.State, duration, len(result.OutputFiles), result.Signatures,
+			)
+		}
+	}
+	if len(r.Operations) > 0 {
+		fmt.Fprintf(tw, "\nTARGET\tOPERATION\tRESULT\n")
+		for _, op := range r.Operations {
+			result := "ok"
+			if !op.OK {
+				result = "failed"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", displayTarget(op.Target, op.Architecture), op.Operation, result)
+		}
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	summary := make([]string, 0, len(packageStates)+1)
+	for _, state := range packageStates {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[state], state))
+	}
+	if count := r.countFailedOperations(); count > 0 {
+		summary = append(summary, fmt.Sprintf("%d repository operations failed", count))
+	}
+	_, err = fmt.Fprintf(w, "\n%s in %s\n", strings.Join(summary, ", "), time.Since(r.startTime).Round(time.Second))
+	return err
+}
+
+// writeFile writes the report into the given file with the given function.
+func (r *Report) writeFile(path string, write func(io.Writer) error) error {
+	var buf bytes.Buffer
+	err := write(&buf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// writeJSON writes the report as a JSON document.
+func (r *Report) writeJSON(w io.Writer) error {
+	packages := r.Packages
+	if packages == nil {
+		packages = []PackageResult{}
+	}
+	operations := r.Operations
+	if operations == nil {
+		operations = []OperationResult{}
+	}
+	data := struct {
+		Packages        []PackageResult      `json:"packages"`
+		Operations      []OperationResult    `json:"operations"`
+		Summary         map[PackageState]int `json:"summary"`
+		DurationSeconds float64              `json:"duration_seconds"`
+	}{packages, operations, r.countPackages(), time.Since(r.startTime).Seconds()}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+func junitClassName(target, arch string) string {
+	if arch == "" {
+		return "art." + target
+	}
+	return "art." + target + "." + arch
+}
+
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
+
+// writeJUnit writes the report as a JUnit XML document, with one test suite
+// for the packages (one test case per package) and one test suite for the
+// repository operations.
+func (r *Report) writeJUnit(w io.Writer) error {
+	packageSuite := junitTestSuite{Name: "packages"}
+	var totalSeconds float64
+	for _, result := range r.Packages {
+		tc := junitTestCase{
+			ClassName: junitClassName(result.Target, result.Architecture),
+			Name:      result.Package,
+			Time:      junitTime(result.DurationSeconds),
+		}
+		switch result.State {
+		case PackageFailed:
+			tc.Failure = &junitMessage{result.Error}
+			packageSuite.Failures++
+		case PackageSkipped:
+			tc.Skipped = &junitMessage{"up to date"}
+			packageSuite.Skipped++
+		}
+		if result.LogPath != "" {
+			tc.SystemOut = "build log: " + result.LogPath
+		}
+		packageSuite.TestCases = append(packageSuite.TestCases, tc)
+		totalSeconds += result.DurationSeconds
+	}
+	packageSuite.Tests = len(packageSuite.TestCases)
+	packageSuite.Time = junitTime(totalSeconds)
+
+	operationSuite := junitTestSuite{Name: "repositories", Time: junitTime(0)}
+	for _, op := range r.Operations {
+		tc := junitTestCase{
+			ClassName: junitClassName(op.Target, op.Architecture),
+			Name:      op.Operation,
+			Time:      junitTime(0),
+		}
+		if !op.OK {
+			tc.Failure = &junitMessage{op.Operation + " failed (see output of art for details)"}
+			operationSuite.Failures++
+		}
+		operationSuite.TestCases = append(operationSuite.TestCases, tc)
+	}
+	operationSuite.Tests = len(operationSuite.TestCases)
+
+	data := junitTestSuites{
+		Name:     "art",
+		Tests:    packageSuite.Tests + operationSuite.Tests,
+		Failures: packageSuite.Failures + operationSuite.Failures,
+		Time:     junitTime(time.Since(r.startTime).Seconds()),
+		Suites:   []junitTestSuite{packageSuite, operationSuite},
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(data)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// startReport enables the collection of a Report for this run, unless this is
+// a dry run (which shows the planned actions instead).
+func (s *Session) startReport(jsonPath, junitPath string) {
+	if s.DryRun != nil {
+		return
+	}
+	s.Report = newReport()
+	s.Report.JSONPath = jsonPath
+	s.Report.JUnitPath = junitPath
+}
@@ -0,0 +1,364 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SigningConfig is the [signing] section of the configuration file.
+type SigningConfig struct {
+	//Backend is one of the SigningBackend... constants. The default is
+	//SigningBackendGPG.
+	Backend string `toml:"backend"`
+	//KeyID is used by SigningBackendGPG. The default is the GPGKEY from
+	//makepkg.conf.
+	KeyID string `toml:"key_id"`
+	//KeyFile is used by SigningBackendKeyFile.
+	KeyFile string `toml:"key_file"`
+	//SignCommand and VerifyCommand are used by SigningBackendCommand. In each
+	//argument, the placeholders "{file}" and "{signature}" are replaced by the
+	//path of the file and the path of its signature, respectively.
+	SignCommand   []string `toml:"sign_command"`
+	VerifyCommand []string `toml:"verify_command"`
+}
+
+const (
+	//SigningBackendGPG signs with gpg(1).
+	SigningBackendGPG = "gpg"
+	//SigningBackendCommand signs with arbitrary external commands.
+	SigningBackendCommand = "command"
+	//SigningBackendKeyFile signs with ART's own OpenPGP implementation, using
+	//an unencrypted secret key from a file.
+	SigningBackendKeyFile = "keyfile"
+)
+
+func (cfg SigningConfig) validate() error {
+	switch cfg.Backend {
+	case "", SigningBackendGPG:
+		return nil
+	case SigningBackendCommand:
+		if len(cfg.SignCommand) == 0 {
+			return errors.New("parse art.toml: missing value for signing.sign_command (required for backend = \"command\")")
+		}
+		return nil
+	case SigningBackendKeyFile:
+		if cfg.KeyFile == "" {
+			return errors.New("parse art.toml: missing value for signing.key_file (required for backend = \"keyfile\")")
+		}
+		return nil
+	default:
+		return fmt.Errorf("parse art.toml: invalid value for signing.backend: %q (expected %q, %q or %q)",
+			cfg.Backend, SigningBackendGPG, SigningBackendCommand, SigningBackendKeyFile)
+	}
+}
+
+// Signer creates and verifies detached signatures. The signature for the file
+// at `path` is always at "$path.sig".
+type Signer interface {
+	//Identity returns a string that identifies the signing key. Cached
+	//verification results are discarded when it changes.
+	Identity() string
+	//Sign creates a signature for the file at the given path.
+	Sign(path string) error
+	//Verify checks that the existing signature for the file at the given path
+	//is valid and was made with the signing key.
+	Verify(path string) error
+}
+
+// newSigner returns the Signer selected by the configuration, or nil if
+// signing is not configured.
+func newSigner(cfg SigningConfig, mcfg MakepkgConfig) (Signer, error) {
+	switch cfg.Backend {
+	case SigningBackendCommand:
+		return &CommandSigner{SignCommand: cfg.SignCommand, VerifyCommand: cfg.VerifyCommand}, nil
+	case SigningBackendKeyFile:
+		return newKeyFileSigner(cfg.KeyFile)
+	default:
+		keyID := cfg.KeyID
+		if keyID == "" {
+			keyID = mcfg.GPGKeyID
+		}
+		if keyID == "" {
+			return nil, nil
+		}
+		return &GPGSigner{KeyID: keyID}, nil
+	}
+}
+
+var errSigningNotConfigured = errors.New("signing is not configured (set GPGKEY in makepkg.conf, or configure the [signing] section in art.toml)")
+
+// resignFile replaces the existing signature for the file at the given path.
+func resignFile(s Signer, path string) error {
+	err := os.Remove(path + ".sig")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.Sign(path)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// GPGSigner
+
+// GPGSigner creates and verifies detached signatures with gpg(1).
+type GPGSigner struct {
+	KeyID string
+	//fingerprints of the key and all its subkeys (filled on first use)
+	fingerprints map[string]bool
+}
+
+// Identity implements the Signer interface.
+func (s *GPGSigner) Identity() string {
+	return s.KeyID
+}
+
+// Sign implements the Signer interface.
+func (s *GPGSigner) Sign(path string) error {
+	cmd := exec.Command(
+		"gpg", "--detach-sign", "--use-agent",
+		"-u", s.KeyID,
+		"--no-armor", path,
+	)
+	cmd.Stdin = nil
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Verify implements the Signer interface.
+func (s *GPGSigner) Verify(path string) error {
+	if s.fingerprints == nil {
+		err := s.resolveKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--status-fd", "1", "--verify", path+".sig", path)
+	cmd.Stdin = nil
+	cmd.Stdout = &stdout
+	cmd.Stderr = nil
+	runErr := cmd.Run()
+
+	//see doc/DETAILS in the GnuPG source for the format of the status lines
+	var (
+		problem     = "signature could not be checked"
+		isGood      = false
+		fingerprint = ""
+	)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimPrefix(scanner.Text(), "[GNUPG:] "))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "GOODSIG":
+			isGood = true
+		case "VALIDSIG":
+			//the last field is the fingerprint of the primary key
+			fingerprint = fields[len(fields)-1]
+		case "BADSIG":
+			problem = "signature does not match file contents"
+		case "EXPSIG":
+			problem = "signature has expired"
+		case "EXPKEYSIG":
+			problem = "signing key has expired"
+		case "REVKEYSIG":
+			problem = "signing key has been revoked"
+		case "ERRSIG":
+			problem = "signature could not be checked (public key missing?)"
+		}
+	}
+	if !isGood || runErr != nil {
+		return fmt.Errorf("invalid signature for %s: %s", path, problem)
+	}
+	if !s.fingerprints[fingerprint] {
+		return fmt.Errorf("invalid signature for %s: made with key %s instead of %s", path, fingerprint, s.KeyID)
+	}
+	return nil
+}
+
+// resolveKey finds the fingerprints of s.KeyID and all its subkeys.
+func (s *GPGSigner) resolveKey() error {
+	var stdout bytes.Buffer
+	cmd := exec.Command("gpg", "--batch", "--with-colons", "--fingerprint", "--fingerprint", s.KeyID)
+	cmd.Stdin = nil
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("cannot find key %s: %s", s.KeyID, err.Error())
+	}
+
+	s.fingerprints = make(map[string]bool)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			s.fingerprints[fields[9]] = true
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CommandSigner
+
+// CommandSigner creates and verifies detached signatures by running external
+// commands, e.g. sq(1) or the client of a signing service.
+type CommandSigner struct {
+	SignCommand []string
+	//VerifyCommand may be empty. In this case, signatures are not verified.
+	VerifyCommand []string
+}
+
+// Identity implements the Signer interface.
+func (s *CommandSigner) Identity() string {
+	return strings.Join(s.SignCommand, " ")
+}
+
+// Sign implements the Signer interface.
+func (s *CommandSigner) Sign(path string) error {
+	cmd := s.command(s.SignCommand, path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("cannot sign %s: %s", path, err.Error())
+	}
+	exists, err := fileExists(path + ".sig")
+	if err == nil && !exists {
+		err = fmt.Errorf("cannot sign %s: %s did not create %s.sig", path, s.SignCommand[0], path)
+	}
+	return err
+}
+
+// Verify implements the Signer interface.
+func (s *CommandSigner) Verify(path string) error {
+	if len(s.VerifyCommand) == 0 {
+		return nil
+	}
+	var output bytes.Buffer
+	cmd := s.command(s.VerifyCommand, path)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(output.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("invalid signature for %s: %s", path, msg)
+	}
+	return nil
+}
+
+func (s *CommandSigner) command(args []string, path string) *exec.Cmd {
+	r := strings.NewReplacer("{file}", path, "{signature}", path+".sig")
+	expanded := make([]string, len(args))
+	for idx, arg := range args {
+		expanded[idx] = r.Replace(arg)
+	}
+	cmd := exec.Command(expanded[0], expanded[1:]...)
+	cmd.Stdin = nil
+	return cmd
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// KeyFileSigner
+
+// KeyFileSigner creates and verifies detached signatures without external
+// tools, using an unencrypted OpenPGP secret key (RSA or Ed25519) from a file.
+type KeyFileSigner struct {
+	Path string
+	//the key used for signing (the first key with secret key material)
+	signingKey *pgpKey
+	//the keys whose signatures are accepted: the signing key, plus its bound
+	//signing subkeys (the signing key comes first)
+	verifyingKeys []pgpKey
+}
+
+func newKeyFileSigner(path string) (*KeyFileSigner, error) {
+	keys, err := readPGPKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &KeyFileSigner{Path: path}
+	for idx := range keys {
+		if keys[idx].RSAPrivate != nil || keys[idx].EdPrivate != nil {
+			s.signingKey = &keys[idx]
+			break
+		}
+	}
+	if s.signingKey == nil {
+		return nil, fmt.Errorf("cannot read %s: no secret key found", path)
+	}
+	s.verifyingKeys = []pgpKey{*s.signingKey}
+	for _, key := range keys {
+		if bytes.Equal(key.PrimaryFingerprint, s.signingKey.Fingerprint) {
+			s.verifyingKeys = append(s.verifyingKeys, key)
+		}
+	}
+	return s, nil
+}
+
+// Identity implements the Signer interface.
+func (s *KeyFileSigner) Identity() string {
+	return s.signingKey.FingerprintString()
+}
+
+// Sign implements the Signer interface.
+func (s *KeyFileSigner) Sign(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sig, err := pgpSign(*s.signingKey, file)
+	if err != nil {
+		return fmt.Errorf("cannot sign %s: %s", path, err.Error())
+	}
+	return ioutil.WriteFile(path+".sig", sig, 0644)
+}
+
+// Verify implements the Signer interface.
+func (s *KeyFileSigner) Verify(path string) error {
+	sig, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = pgpVerify(s.verifyingKeys, sig, file)
+	if err != nil {
+		return fmt.Errorf("invalid signature for %s: %s", path, err.Error())
+	}
+	return nil
+}
@@ -27,11 +27,29 @@ import (
 
 // Source describes a directory from which packages are read.
 type Source struct {
-	Path     string    `toml:"path"`
+	Path string `toml:"path"`
+	//TargetName is the name of the target repository that the packages from
+	//this source go into. It may be omitted if there is only one target.
+	TargetName string      `toml:"target"`
+	Target     *Repository `toml:"-"`
+	//Builder is either BuilderHost or BuilderChroot (if empty, the builder of
+	//the target is used).
+	Builder  string    `toml:"builder"`
 	Packages []Package `toml:"-"`
 }
 
-func (s *Source) discoverPackages(mcfg MakepkgConfig) error {
+// discoverPackages fills s.Packages. Native packages will be built in the
+// given chroot, or on the host if `chroot` is nil.
+func (s *Source) discoverPackages(mcfg MakepkgConfig, chroot *ChrootBuilder) error {
+	var variant ArchVariant
+	if s.Target.Architecture != "" {
+		mcfg.Architecture = s.Target.Architecture
+		variant = ArchVariant{
+			Arch:            s.Target.Architecture,
+			SkipAnyPackages: s.Target.AnyPackagesFrom != nil,
+		}
+	}
+
 	dir, err := os.Open(s.Path)
 	if err != nil {
 		return err
@@ -58,6 +76,8 @@ func (s *Source) discoverPackages(mcfg MakepkgConfig) error {
 				s.Packages = append(s.Packages, &NativePackage{
 					Path:          filepath.Join(pkgPath, "PKGBUILD"),
 					MakepkgConfig: mcfg,
+					Chroot:        chroot,
+					ArchVariant:   variant,
 				})
 			}
 		}
@@ -67,6 +87,8 @@ func (s *Source) discoverPackages(mcfg MakepkgConfig) error {
 			s.Packages = append(s.Packages, &NativePackage{
 				Path:          pkgPath,
 				MakepkgConfig: mcfg,
+				Chroot:        chroot,
+				ArchVariant:   variant,
 			})
 		}
 
@@ -75,6 +97,7 @@ func (s *Source) discoverPackages(mcfg MakepkgConfig) error {
 			s.Packages = append(s.Packages, &HoloBuildPackage{
 				Path:          pkgPath,
 				MakepkgConfig: mcfg,
+				ArchVariant:   variant,
 			})
 		}
 	}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SrcInfo contains the fields from the output of `makepkg --printsrcinfo`
+// that interest us. Fields that can appear both in the pkgbase section and in
+// pkgname sections are merged over all sections.
+type SrcInfo struct {
+	PackageBase  string
+	PackageNames []string
+	Version      string
+	Release      string
+	Epoch        string
+	Depends      []string
+	MakeDepends  []string
+	CheckDepends []string
+	Provides     []string
+	Sources      []string
+	Install      []string
+	Changelog    []string
+}
+
+// parseSrcInfo parses the output of `makepkg --printsrcinfo`. Architecture-
+// specific fields (e.g. "depends_x86_64") are only considered if they match
+// the given architecture.
+func parseSrcInfo(buf []byte, arch string) (SrcInfo, error) {
+	var info SrcInfo
+	for idx, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			return SrcInfo{}, fmt.Errorf("parse .SRCINFO: syntax error in line %d: %q", idx+1, line)
+		}
+		key := strings.TrimSpace(fields[0])
+		value := strings.TrimSpace(fields[1])
+
+		//strip architecture suffix
+		if i := strings.Index(key, "_"); i != -1 {
+			if key[i+1:] != arch {
+				continue
+			}
+			key = key[:i]
+		}
+
+		switch key {
+		case "pkgbase":
+			info.PackageBase = value
+		case "pkgname":
+			info.PackageNames = append(info.PackageNames, value)
+		case "pkgver":
+			info.Version = value
+		case "pkgrel":
+			info.Release = value
+		case "epoch":
+			info.Epoch = value
+		case "depends":
+			info.Depends = append(info.Depends, value)
+		case "makedepends":
+			info.MakeDepends = append(info.MakeDepends, value)
+		case "checkdepends":
+			info.CheckDepends = append(info.CheckDepends, value)
+		case "provides":
+			info.Provides = append(info.Provides, value)
+		case "source":
+			info.Sources = append(info.Sources, value)
+		case "install":
+			info.Install = append(info.Install, value)
+		case "changelog":
+			info.Changelog = append(info.Changelog, value)
+		}
+	}
+
+	if info.PackageBase == "" {
+		return SrcInfo{}, fmt.Errorf("parse .SRCINFO: missing pkgbase")
+	}
+	if len(info.PackageNames) == 0 {
+		info.PackageNames = []string{info.PackageBase}
+	}
+	return info, nil
+}
+
+// stripVersionConstraint turns a dependency specification like "foo>=1.0"
+// into the bare package name "foo".
+func stripVersionConstraint(spec string) string {
+	if i := strings.IndexAny(spec, "<>="); i != -1 {
+		return spec[:i]
+	}
+	return spec
+}
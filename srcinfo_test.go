@@ -0,0 +1,159 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSrcInfo(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Arch     string
+		Expected SrcInfo
+		Error    string
+	}{
+		//minimal package: pkgname defaults to pkgbase
+		{
+			Input:    "pkgbase = foo\n\tpkgver = 1.0\n\tpkgrel = 1\n",
+			Arch:     "x86_64",
+			Expected: SrcInfo{PackageBase: "foo", PackageNames: []string{"foo"}, Version: "1.0", Release: "1"},
+		},
+		//split package with fields in multiple sections, comments and blank lines
+		{
+			Input: `# Generated by makepkg
+pkgbase = foo
+	pkgver = 2.3
+	pkgrel = 4.1
+	epoch = 1
+	makedepends = cmake
+	checkdepends = python
+	depends = glibc
+	source = foo-2.3.tar.gz
+	source = fix-build.patch
+	install = foo.install
+	changelog = ChangeLog
+
+pkgname = foo-libs
+	provides = libfoo.so=1-64
+	depends = zlib>=1.2
+
+pkgname = foo-tools
+	depends = foo-libs
+`,
+			Arch: "x86_64",
+			Expected: SrcInfo{
+				PackageBase:  "foo",
+				PackageNames: []string{"foo-libs", "foo-tools"},
+				Version:      "2.3",
+				Release:      "4.1",
+				Epoch:        "1",
+				Depends:      []string{"glibc", "zlib>=1.2", "foo-libs"},
+				MakeDepends:  []string{"cmake"},
+				CheckDepends: []string{"python"},
+				Provides:     []string{"libfoo.so=1-64"},
+				Sources:      []string{"foo-2.3.tar.gz", "fix-build.patch"},
+				Install:      []string{"foo.install"},
+				Changelog:    []string{"ChangeLog"},
+			},
+		},
+		//architecture-specific fields only count for the matching architecture
+		{
+			Input: `pkgbase = bar
+	pkgver = 1
+	pkgrel = 1
+	depends = common
+	depends_x86_64 = lib32-common
+	depends_aarch64 = arm-common
+	source_aarch64 = bar-aarch64.tar.gz
+	makedepends_x86_64 = nasm
+`,
+			Arch: "aarch64",
+			Expected: SrcInfo{
+				PackageBase:  "bar",
+				PackageNames: []string{"bar"},
+				Version:      "1",
+				Release:      "1",
+				Depends:      []string{"common", "arm-common"},
+				Sources:      []string{"bar-aarch64.tar.gz"},
+			},
+		},
+		//values may contain "=" and surrounding whitespace is ignored
+		{
+			Input: "pkgbase=baz\npkgver =  0.1  \npkgrel= 2\nprovides = baz-git=0.1\n",
+			Arch:  "x86_64",
+			Expected: SrcInfo{
+				PackageBase:  "baz",
+				PackageNames: []string{"baz"},
+				Version:      "0.1",
+				Release:      "2",
+				Provides:     []string{"baz-git=0.1"},
+			},
+		},
+		//errors
+		{
+			Input: "pkgname = foo\n",
+			Arch:  "x86_64",
+			Error: "parse .SRCINFO: missing pkgbase",
+		},
+		{
+			Input: "pkgbase = foo\n\tpkgver 1.0\n",
+			Arch:  "x86_64",
+			Error: `parse .SRCINFO: syntax error in line 2: "pkgver 1.0"`,
+		},
+	}
+
+	for idx, c := range testCases {
+		actual, err := parseSrcInfo([]byte(c.Input), c.Arch)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		if errMsg != c.Error {
+			t.Errorf("test case %d: expected error %q, got %q", idx, c.Error, errMsg)
+			continue
+		}
+		if !reflect.DeepEqual(actual, c.Expected) {
+			t.Errorf("test case %d: expected %#v, got %#v", idx, c.Expected, actual)
+		}
+	}
+}
+
+func TestStripVersionConstraint(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected string
+	}{
+		{"foo", "foo"},
+		{"foo>=1.2", "foo"},
+		{"foo<=1.2", "foo"},
+		{"foo>1.2", "foo"},
+		{"foo<2", "foo"},
+		{"foo=1:1.2-3", "foo"},
+		{"libfoo.so=1-64", "libfoo.so"},
+		{"python-foo-bar>=0.5", "python-foo-bar"},
+	}
+	for _, c := range testCases {
+		actual := stripVersionConstraint(c.Input)
+		if actual != c.Expected {
+			t.Errorf("expected stripVersionConstraint(%q) = %q, got %q", c.Input, c.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// StatusState is the state of a file in a target directory, as reported by
+// `art status`.
+type StatusState string
+
+// Possible values for StatusState.
+const (
+	//StatusUpToDate means that the file is built, signed (if signing is
+	//configured) and published in the repository metadata.
+	StatusUpToDate StatusState = "up-to-date"
+	//StatusNeedsBuild means that the file is missing, or that its package
+	//definition has changed since it was built.
+	StatusNeedsBuild StatusState = "needs-build"
+	//StatusNotPublished means that the file is built, but not in the repository
+	//metadata (or the metadata refers to a different build of it).
+	StatusNotPublished StatusState = "not-published"
+	//StatusFileMissing means that the file is in the repository metadata, but
+	//missing from the target directory.
+	StatusFileMissing StatusState = "file-missing"
+	//StatusOrphaned means that the file is not an output file of any
+	//package, and will be removed by `art prune`.
+	StatusOrphaned StatusState = "orphaned"
+	//StatusUnsigned means that the file is built and published, but not signed.
+	StatusUnsigned StatusState = "unsigned"
+)
+
+var statusStates = []StatusState{StatusUpToDate, StatusNeedsBuild, StatusNotPublished, StatusFileMissing, StatusOrphaned, StatusUnsigned}
+
+var statusLabels = map[StatusState]string{
+	StatusUpToDate:     "up-to-date",
+	StatusNeedsBuild:   "needs build",
+	StatusNotPublished: "built, not in DB",
+	StatusFileMissing:  "in DB, file missing",
+	StatusOrphaned:     "orphaned",
+	StatusUnsigned:     "unsigned",
+}
+
+// StatusEntry describes the state of a file in a target directory.
+type StatusEntry struct {
+	Target       string `json:"target"`
+	Architecture string `json:"architecture,omitempty"`
+	//Package is the CacheKey() of the package that produces this file. It is
+	//empty for files that do not belong to any package.
+	Package   string      `json:"package,omitempty"`
+	FileName  string      `json:"file"`
+	State     StatusState `json:"state"`
+	Built     bool        `json:"built"`
+	Signed    bool        `json:"signed"`
+	Published bool        `json:"published"`
+}
+
+// collectStatus compares the output files of all packages with the contents
+// of the target directories and their repository metadata.
+func (s *Session) collectStatus() (result []StatusEntry, ok bool) {
+	ok = true
+	for _, target := range s.Config.Targets {
+		entries, err := s.collectStatusForTarget(target)
+		if err != nil {
+			s.UI.ShowError(err)
+			ok = false
+			continue
+		}
+		result = append(result, entries...)
+	}
+	return
+}
+
+func (s *Session) collectStatusForTarget(target *Repository) ([]StatusEntry, error) {
+	metadata, err := target.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	metadataByFileName := make(map[string]RepositoryEntry, len(metadata))
+	for _, entry := range metadata {
+		metadataByFileName[entry.FileName] = entry
+	}
+
+	var (
+		result      []StatusEntry
+		outputFiles []string
+	)
+	newEntry := func(fileName string) StatusEntry {
+		return StatusEntry{
+			Target:       target.Name,
+			Architecture: target.Architecture,
+			FileName:     fileName,
+		}
+	}
+
+	//output files of the packages going into this target (or into the first
+	//architecture of this target, for output files for architecture "any")
+	for _, src := range s.Config.Sources {
+		isLinked := target.AnyPackagesFrom != nil && src.Target == target.AnyPackagesFrom
+		if src.Target != target && !isLinked {
+			continue
+		}
+		for _, pkg := range src.Packages {
+			pkgEntry, err := s.Cache.GetEntryForPackage(pkg)
+			if err != nil {
+				return nil, err
+			}
+			needsRebuild := pkgEntry.BuiltContentHash != "" && pkgEntry.BuiltContentHash != pkgEntry.ContentHash
+			for _, fileName := range pkgEntry.OutputFiles {
+				if isLinked && !isAnyPackageFile(fileName) {
+					continue
+				}
+				//for linked files, the symlink is only created when publishing
+				//(except for files restored by `art rollback`)
+				fileName = s.pinnedFileName(src.Target, fileName)
+				path := filepath.Join(src.Target.Path, fileName)
+				if isLinked {
+					if pinned := s.pinnedFileName(target, fileName); pinned != fileName {
+						fileName = pinned
+						path = filepath.Join(target.Path, fileName)
+					}
+				}
+				outputFiles = append(outputFiles, fileName)
+				entry := newEntry(fileName)
+				entry.Package = pkg.CacheKey()
+				entry.Built, entry.Signed, err = fileAndSignatureExist(path)
+				if err != nil {
+					return nil, err
+				}
+				dbEntry, exists := metadataByFileName[fileName]
+				if exists && entry.Built {
+					cacheEntry, err := s.Cache.GetEntryForOutputFile(path)
+					if err != nil {
+						return nil, err
+					}
+					entry.Published = dbEntry.MD5Digest == cacheEntry.MD5Digest
+				}
+
+				switch {
+				case !entry.Built && exists:
+					entry.State = StatusFileMissing
+				case !entry.Built || needsRebuild:
+					entry.State = StatusNeedsBuild
+				case !entry.Published:
+					entry.State = StatusNotPublished
+				case !entry.Signed && s.Signer != nil:
+					entry.State = StatusUnsigned
+				default:
+					entry.State = StatusUpToDate
+				}
+				result = append(result, entry)
+			}
+		}
+	}
+
+	//entries in the repository metadata that do not belong to any package
+	isOutputFile := make(map[string]bool, len(outputFiles))
+	for _, fileName := range outputFiles {
+		isOutputFile[fileName] = true
+	}
+	var extraEntries []StatusEntry
+	isListed := make(map[string]bool)
+	for _, dbEntry := range metadata {
+		if isOutputFile[dbEntry.FileName] {
+			continue
+		}
+		entry := newEntry(dbEntry.FileName)
+		entry.Built, entry.Signed, err = fileAndSignatureExist(filepath.Join(target.Path, dbEntry.FileName))
+		if err != nil {
+			return nil, err
+		}
+		entry.Published = true
+		if entry.Built {
+			entry.State = StatusOrphaned
+		} else {
+			entry.State = StatusFileMissing
+		}
+		extraEntries = append(extraEntries, entry)
+		isListed[dbEntry.FileName] = true
+	}
+
+	//package files in the target directory that do not belong to any package
+	fileNames, err := target.findOldPackageFiles(outputFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range fileNames {
+		if isListed[fileName] {
+			continue
+		}
+		entry := newEntry(fileName)
+		entry.Built, entry.Signed, err = fileAndSignatureExist(filepath.Join(target.Path, fileName))
+		if err != nil {
+			return nil, err
+		}
+		entry.State = StatusOrphaned
+		extraEntries = append(extraEntries, entry)
+	}
+
+	sort.Slice(extraEntries, func(i, j int) bool { return extraEntries[i].FileName < extraEntries[j].FileName })
+	return append(result, extraEntries...), nil
+}
+
+// fileAndSignatureExist checks whether the given file and its signature exist.
+func fileAndSignatureExist(path string) (exists, signatureExists bool, err error) {
+	exists, err = fileExists(path)
+	if err != nil {
+		return
+	}
+	signatureExists, err = fileExists(path + ".sig")
+	return
+}
+
+// countStatusEntries counts the given entries by state.
+func countStatusEntries(entries []StatusEntry) map[StatusState]int {
+	counts := make(map[StatusState]int, len(statusStates))
+	for _, state := range statusStates {
+		counts[state] = 0
+	}
+	for _, entry := range entries {
+		counts[entry.State]++
+	}
+	return counts
+}
+
+// printStatusTable prints the given entries in a human-readable table,
+// followed by a summary line.
+func printStatusTable(w io.Writer, entries []StatusEntry, withTarget bool) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if withTarget {
+		fmt.Fprintf(tw, "TARGET\t")
+	}
+	fmt.Fprintf(tw, "FILE\tSTATE\n")
+	for _, entry := range entries {
+		if withTarget {
+			target := entry.Target
+			if entry.Architecture != "" {
+				target += " (" + entry.Architecture + ")"
+			}
+			fmt.Fprintf(tw, "%s\t", target)
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", entry.FileName, statusLabels[entry.State])
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	counts := countStatusEntries(entries)
+	var summary []string
+	for _, state := range statusStates {
+		if counts[state] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[state], statusLabels[state]))
+		}
+	}
+	if len(summary) == 0 {
+		summary = []string{"no files"}
+	}
+	_, err = fmt.Fprintf(w, "\n%s\n", strings.Join(summary, ", "))
+	return err
+}
+
+// printStatusJSON prints the given entries as a JSON document.
+func printStatusJSON(w io.Writer, entries []StatusEntry) error {
+	if entries == nil {
+		entries = []StatusEntry{}
+	}
+	data := struct {
+		Files   []StatusEntry       `json:"files"`
+		Summary map[StatusState]int `json:"summary"`
+	}{entries, countStatusEntries(entries)}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
@@ -18,40 +18,91 @@
 
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
 
-// UI encapsulates the state of the terminal display.
+// UI encapsulates the state of the terminal display. It is safe for
+// concurrent use.
 type UI struct {
-	task  string
-	step  uint
-	count uint
+	//Output is where all messages and progress displays are printed. If nil,
+	//os.Stdout is used.
+	Output io.Writer
+	task   string
+	step   uint
+	count  uint
+	mutex  sync.Mutex
+}
+
+func (ui *UI) writer() io.Writer {
+	if ui.Output == nil {
+		return os.Stdout
+	}
+	return ui.Output
 }
 
 // ShowError prints the given error if it is not nil.
 func (ui *UI) ShowError(err error) {
 	if err != nil {
+		ui.mutex.Lock()
+		defer ui.mutex.Unlock()
 		if ui.task != "" {
-			fmt.Printf("\n")
+			fmt.Fprintf(ui.writer(), "\n")
 		}
-		fmt.Printf("\x1B[1;31m[error] \x1B[0;31m%s\x1B[0m\n", err.Error())
+		fmt.Fprintf(ui.writer(), "\x1B[1;31m[error] \x1B[0;31m%s\x1B[0m\n", err.Error())
 	}
 }
 
 // ShowWarning prints the given warning.
 func (ui *UI) ShowWarning(msg string, args ...interface{}) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
 	if ui.task != "" {
-		fmt.Printf("\n")
+		fmt.Fprintf(ui.writer(), "\n")
 	}
 	if len(args) > 0 {
 		msg = fmt.Sprintf(msg, args...)
 	}
-	fmt.Printf("\x1B[1;33m[ warn] \x1B[0;33m%s\x1B[0m\n", msg)
+	fmt.Fprintf(ui.writer(), "\x1B[1;33m[ warn] \x1B[0;33m%s\x1B[0m\n", msg)
+}
+
+// ShowInfo prints the given informational message.
+func (ui *UI) ShowInfo(msg string, args ...interface{}) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	if ui.task != "" {
+		fmt.Fprintf(ui.writer(), "\n")
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	fmt.Fprintf(ui.writer(), "\x1B[1;32m[ info] \x1B[0;32m%s\x1B[0m\n", msg)
+}
+
+// ShowOutput prints the captured output of an external program, with the given
+// title above it.
+func (ui *UI) ShowOutput(title string, output []byte) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	if ui.task != "" {
+		fmt.Fprintf(ui.writer(), "\n")
+	}
+	fmt.Fprintf(ui.writer(), "\x1B[1m==> %s\x1B[0m\n", title)
+	ui.writer().Write(output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		fmt.Fprintf(ui.writer(), "\n")
+	}
 }
 
 // SetCurrentTask displays the progress of the next task.
 func (ui *UI) SetCurrentTask(task string, count uint) {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
 	if ui.task != "" {
-		ui.EndTask()
+		ui.endTask()
 	}
 	ui.task = task
 	ui.step = 0
@@ -61,16 +112,24 @@ func (ui *UI) SetCurrentTask(task string, count uint) {
 
 // StepTask increases the counter on the task.
 func (ui *UI) StepTask() {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
 	ui.step++
 	ui.displayTask()
 }
 
 // EndTask signals the end of the current task.
 func (ui *UI) EndTask() {
+	ui.mutex.Lock()
+	defer ui.mutex.Unlock()
+	ui.endTask()
+}
+
+func (ui *UI) endTask() {
 	if ui.task != "" {
 		ui.step = ui.count
 		ui.displayTask()
-		fmt.Printf("\n")
+		fmt.Fprintf(ui.writer(), "\n")
 
 		ui.task = ""
 		ui.step = 0
@@ -83,7 +142,7 @@ func (ui *UI) displayTask() {
 	if ui.count > 0 {
 		progress = fmt.Sprintf("%2d/%2d", ui.step, ui.count)
 	}
-	fmt.Printf(""+
+	fmt.Fprintf(ui.writer(), ""+
 		"\r"+ // move cursor to beginning of line
 		"\x1B[1;36m"+ // bold ("1") and set the foreground color to cyan ("36")
 		"[%s] "+
@@ -22,17 +22,8 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"os"
-	"time"
 )
 
-// Returns true if the two times differ by less than a second.
-func fuzzyTimeEqual(t1 time.Time, t2 time.Time) bool {
-	unix1 := t1.UnixNano()
-	unix2 := t2.UnixNano()
-	diff := unix1 - unix2
-	return diff > -1e9 && diff < 1e9
-}
-
 func fileExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	switch {
@@ -0,0 +1,170 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"strings"
+)
+
+// vercmp compares two package versions (in the format "[epoch:]pkgver[-pkgrel]")
+// in the same way as vercmp(8) from pacman. It returns -1 if a is older than
+// b, 0 if both are equal, and 1 if a is newer than b.
+func vercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	epochA, versionA, releaseA := splitVersion(a)
+	epochB, versionB, releaseB := splitVersion(b)
+	result := rpmvercmp(epochA, epochB)
+	if result == 0 {
+		result = rpmvercmp(versionA, versionB)
+		if result == 0 && releaseA != "" && releaseB != "" {
+			result = rpmvercmp(releaseA, releaseB)
+		}
+	}
+	return result
+}
+
+// splitVersion splits a version string into epoch, pkgver and pkgrel. The
+// epoch defaults to "0".
+func splitVersion(version string) (epoch, pkgver, pkgrel string) {
+	epoch = "0"
+	if idx := strings.Index(version, ":"); idx >= 0 && isAllDigits(version[:idx]) {
+		epoch = version[:idx]
+		if epoch == "" {
+			epoch = "0"
+		}
+		version = version[idx+1:]
+	}
+	if idx := strings.LastIndex(version, "-"); idx >= 0 {
+		return epoch, version[:idx], version[idx+1:]
+	}
+	return epoch, version, ""
+}
+
+func isAllDigits(s string) bool {
+	for _, c := range s {
+		if !isDigit(byte(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || isAlpha(c)
+}
+
+// rpmvercmp compares two version segments like rpmvercmp() in libalpm: Both
+// strings are split into alternating runs of digits and letters, which are
+// compared one after the other (numerically for digits, lexically for
+// letters). A run of digits is always newer than a run of letters.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	one, two := 0, 0 //current positions in a and b
+	for one < len(a) && two < len(b) {
+		//skip separators
+		start1, start2 := one, two
+		for one < len(a) && !isAlnum(a[one]) {
+			one++
+		}
+		for two < len(b) && !isAlnum(b[two]) {
+			two++
+		}
+		if one == len(a) || two == len(b) {
+			break
+		}
+		//if the separator lengths were different, we are also finished
+		if one-start1 != two-start2 {
+			if one-start1 < two-start2 {
+				return -1
+			}
+			return 1
+		}
+
+		//grab the next run of digits or letters from both strings
+		end1, end2 := one, two
+		isNum := isDigit(a[one])
+		if isNum {
+			for end1 < len(a) && isDigit(a[end1]) {
+				end1++
+			}
+			for end2 < len(b) && isDigit(b[end2]) {
+				end2++
+			}
+		} else {
+			for end1 < len(a) && isAlpha(a[end1]) {
+				end1++
+			}
+			for end2 < len(b) && isAlpha(b[end2]) {
+				end2++
+			}
+		}
+		segment1, segment2 := a[one:end1], b[two:end2]
+
+		//this cannot happen for `a` since we checked for an alphanumeric char
+		//above; for `b`, the runs have different types
+		if segment2 == "" {
+			if isNum {
+				return 1
+			}
+			return -1
+		}
+
+		if isNum {
+			//numeric comparison: longer number (without leading zeros) wins
+			segment1 = strings.TrimLeft(segment1, "0")
+			segment2 = strings.TrimLeft(segment2, "0")
+			if len(segment1) != len(segment2) {
+				if len(segment1) > len(segment2) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if cmp := strings.Compare(segment1, segment2); cmp != 0 {
+			return cmp
+		}
+
+		one, two = end1, end2
+	}
+
+	//this catches the case where all segments compared identically, but
+	//the separators were different
+	if one == len(a) && two == len(b) {
+		return 0
+	}
+	//the final showdown: we never want a remaining alpha string to beat an
+	//empty string
+	if (one == len(a) && !isAlpha(b[two])) || (one < len(a) && isAlpha(a[one])) {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,213 @@
+/*******************************************************************************
+*
+* Copyright 2017 Stefan Majewsky <majewsky@gmx.net>
+*
+* This program is free software: you can redistribute it and/or modify it under
+* the terms of the GNU General Public License as published by the Free Software
+* Foundation, either version 3 of the License, or (at your option) any later
+* version.
+*
+* This program is distributed in the hope that it will be useful, but WITHOUT ANY
+* WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+* A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License along with
+* this program. If not, see <http://www.gnu.org/licenses/>.
+*
+*******************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// test vectors from pacman's test/util/vercmptest.sh
+var vercmpTestCases = []struct {
+	A, B     string
+	Expected int
+}{
+	//all similar length, no pkgrel
+	{"1.5.0", "1.5.0", 0},
+	{"1.5.1", "1.5.0", 1},
+	//mixed length
+	{"1.5.1", "1.5", 1},
+	//with pkgrel, simple
+	{"1.5.0-1", "1.5.0-1", 0},
+	{"1.5.0-1", "1.5.0-2", -1},
+	{"1.5.0-1", "1.5.1-1", -1},
+	{"1.5.0-2", "1.5.1-1", -1},
+	//with pkgrel, mixed lengths
+	{"1.5-1", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-1", -1},
+	{"1.5-2", "1.5.1-2", -1},
+	//mixed pkgrel inclusion
+	{"1.5", "1.5-1", 0},
+	{"1.5-1", "1.5", 0},
+	{"1.1-1", "1.1", 0},
+	{"1.0-1", "1.1", -1},
+	{"1.1-1", "1.0", 1},
+	//alphanumeric versions
+	{"1.5b-1", "1.5-1", -1},
+	{"1.5b", "1.5", -1},
+	{"1.5b-1", "1.5", -1},
+	{"1.5b", "1.5.1", -1},
+	//from the manpage
+	{"1.0a", "1.0alpha", -1},
+	{"1.0alpha", "1.0b", -1},
+	{"1.0b", "1.0beta", -1},
+	{"1.0beta", "1.0rc", -1},
+	{"1.0rc", "1.0", -1},
+	//going crazy? alpha-dotted versions
+	{"1.5.a", "1.5", 1},
+	{"1.5.b", "1.5.a", 1},
+	{"1.5.1", "1.5.b", 1},
+	//alpha dots and dashes
+	{"1.5.b-1", "1.5.b", 0},
+	{"1.5-1", "1.5.b", -1},
+	//same/similar content, differing separators
+	{"2.0", "2_0", 0},
+	{"2.0_a", "2_0.a", 0},
+	{"2.0a", "2.0.a", -1},
+	{"2___a", "2_a", 1},
+	//epoch included version comparisons
+	{"0:1.0", "0:1.0", 0},
+	{"0:1.0", "0:1.1", -1},
+	{"1:1.0", "0:1.0", 1},
+	{"1:1.0", "0:1.1", 1},
+	{"1:1.0", "2:1.1", -1},
+	//epoch + sometimes present pkgrel
+	{"1:1.0", "0:1.0-1", 1},
+	{"1:1.0-1", "0:1.1-1", 1},
+	//epoch included on one version
+	{"0:1.0", "1.0", 0},
+	{"0:1.0", "1.1", -1},
+	{"0:1.1", "1.0", 1},
+	{"1:1.0", "1.0", 1},
+	{"1:1.0", "1.1", 1},
+	{"1:1.1", "1.1", 1},
+}
+
+func TestVercmp(t *testing.T) {
+	for _, c := range vercmpTestCases {
+		//like vercmptest.sh, check both directions
+		if actual := vercmp(c.A, c.B); actual != c.Expected {
+			t.Errorf("expected vercmp(%q, %q) = %d, got %d", c.A, c.B, c.Expected, actual)
+		}
+		if actual := vercmp(c.B, c.A); actual != -c.Expected {
+			t.Errorf("expected vercmp(%q, %q) = %d, got %d", c.B, c.A, -c.Expected, actual)
+		}
+	}
+}
+
+func TestParsePackageFileName(t *testing.T) {
+	testCases := []struct {
+		FileName string
+		Name     string
+		Version  string
+		OK       bool
+	}{
+		{"foo-1.0-1-x86_64.pkg.tar.zst", "foo", "1.0-1", true},
+		{"foo-bar-1:2.3-4-x86_64.pkg.tar.zst", "foo-bar", "1:2.3-4", true},
+		{"foo-bar-baz-2.3.r12.gabcdef-1-any.pkg.tar.xz", "foo-bar-baz", "2.3.r12.gabcdef-1", true},
+		{"foo-1.0-1.1-x86_64.pkg.tar", "foo", "1.0-1.1", true},
+		{"foo-1.0-1-x86_64.pkg.tar.zst.sig", "foo", "1.0-1", true},
+		//not enough fields
+		{"foo-1.0-x86_64.pkg.tar.zst", "", "", false},
+		{"foo.pkg.tar.zst", "", "", false},
+		//not a package file
+		{"foo-1.0-1-x86_64.tar.gz", "", "", false},
+		{"example.db.tar.gz", "", "", false},
+	}
+	for _, c := range testCases {
+		name, version, ok := parsePackageFileName(c.FileName)
+		if name != c.Name || version != c.Version || ok != c.OK {
+			t.Errorf("expected parsePackageFileName(%q) = (%q, %q, %t), got (%q, %q, %t)",
+				c.FileName, c.Name, c.Version, c.OK, name, version, ok)
+		}
+	}
+}
+
+func TestFindOldArchivedFiles(t *testing.T) {
+	repoPath, err := ioutil.TempDir("", "art-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoPath)
+	repo := Repository{Name: "test", Path: repoPath}
+
+	//no archive directory at all
+	repo.KeepVersions = 2
+	expectOldArchivedFiles(t, repo, nil, nil)
+
+	touch := func(path string) {
+		t.Helper()
+		err := ioutil.WriteFile(path, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(repo.ArchivePath(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range []string{
+		"foo-1.9-1-x86_64.pkg.tar.zst",
+		"foo-1.10-1-x86_64.pkg.tar.zst",
+		"foo-1.10-1-x86_64.pkg.tar.zst.sig",
+		"foo-1.8-1-x86_64.pkg.tar.zst",
+		//same version with a different compression format counts only once
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1:0.1-1-x86_64.pkg.tar.zst",
+		"foo-bar-2.0-1-any.pkg.tar.zst",
+		"foo-bar-1.0-1-any.pkg.tar.zst",
+		"not-a-package.txt",
+	} {
+		touch(filepath.Join(repo.ArchivePath(), fileName))
+	}
+	//this file was restored by a rollback, so it is not old
+	touch(filepath.Join(repoPath, "foo-1.10-1-x86_64.pkg.tar.zst"))
+
+	repo.KeepVersions = 2
+	expectOldArchivedFiles(t, repo, nil, []string{
+		"foo-1.10-1-x86_64.pkg.tar.zst",
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1.8-1-x86_64.pkg.tar.zst",
+	})
+
+	repo.KeepVersions = 1
+	expectOldArchivedFiles(t, repo, nil, []string{
+		"foo-1.10-1-x86_64.pkg.tar.zst",
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1.8-1-x86_64.pkg.tar.zst",
+		"foo-1.9-1-x86_64.pkg.tar.zst",
+		"foo-bar-1.0-1-any.pkg.tar.zst",
+	})
+
+	//additional files (as in dry runs) are treated as if they were archived
+	repo.KeepVersions = 1
+	expectOldArchivedFiles(t, repo, []string{"foo-bar-3.0-1-any.pkg.tar.zst"}, []string{
+		"foo-1.10-1-x86_64.pkg.tar.zst",
+		"foo-1.8-1-x86_64.pkg.tar.xz",
+		"foo-1.8-1-x86_64.pkg.tar.zst",
+		"foo-1.9-1-x86_64.pkg.tar.zst",
+		"foo-bar-1.0-1-any.pkg.tar.zst",
+		"foo-bar-2.0-1-any.pkg.tar.zst",
+	})
+}
+
+func expectOldArchivedFiles(t *testing.T, repo Repository, additional, expected []string) {
+	t.Helper()
+	actual, err := repo.findOldArchivedFiles(additional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("with KeepVersions = %d: expected old archived files %v, got %v",
+			repo.KeepVersions, expected, actual)
+	}
+}